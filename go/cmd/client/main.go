@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"github.com/4kills/hole-punching/go/pkg/client"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
 	"log"
 	"net"
 	"os"
@@ -12,14 +13,15 @@ import (
 )
 
 type chat struct {
-	addrs []*net.UDPAddr
+	peers []client.Peer
 	socket *net.UDPConn
+	session client.Session
 
 	keepAlivePeriod time.Duration
 }
 
 func initConnection() (chat, error) {
-	usage := "Usage:\nclient <rendezvous> <id> <num_peers>."
+	usage := "Usage:\nclient <rendezvous> <id> <num_peers> [name]."
 	if len(os.Args) < 4 {
 		return chat{}, fmt.Errorf("not enough arguments provided. Provided: %v. %s", os.Args[1:], usage)
 	}
@@ -36,8 +38,15 @@ func initConnection() (chat, error) {
 		return chat{}, err
 	}
 
-	addrs, s, err := c.Connect([]byte(id), numPeers)
-	return chat{addrs: addrs, socket: s, keepAlivePeriod: 5 * time.Second}, err
+	if len(os.Args) > 4 {
+		c.Metadata = []byte(os.Args[4]) // shown to the other peers
+	}
+	c.KeepRegistered = true
+	session, err := c.Connect([]byte(id), numPeers)
+	if session.Reflexive != nil {
+		log.Println("Public endpoint:", session.Reflexive)
+	}
+	return chat{peers: session.Peers, socket: session.Socket, session: session, keepAlivePeriod: session.KeepAlivePeriod}, err
 }
 
 func main() {
@@ -48,35 +57,45 @@ func main() {
 		panic(err)
 	}
 
-	log.Println("Connection established with", len(c.addrs), "peers.")
+	log.Println("Connection established with", len(c.peers), "peers.")
+	if c.session.Index > 0 {
+		log.Printf("I am peer %d. Leading: %t.", c.session.Index, c.session.IsLeader())
+	}
 	time.Sleep(time.Second * 2)
 
 	go c.keepAlive()
 
 	go c.receive()
 
+	go c.events()
+
 	c.send()
 }
 
 func (c chat) receive() {
-	m := map[string]int{}
-	for i, addr := range c.addrs {
-		m[addr.String()] = i
+	m := map[string]string{}
+	for i, peer := range c.peers {
+		m[peer.Addr.String()] = fmt.Sprintf("Peer %d:", i)
+		if peer.Index > 0 { // numbered by the server, so all participants agree
+			m[peer.Addr.String()] = fmt.Sprintf("Peer %d:", peer.Index)
+		}
+		if len(peer.Metadata) > 0 {
+			m[peer.Addr.String()] = string(peer.Metadata) + ":"
+		}
 	}
 
 	b := make([]byte, 0xffff)
 	t := time.Now()
 
 	for {
-		n, p, _ := c.socket.ReadFromUDP(b)
-		if n == 0 {
+		n, p, err := c.session.ReadFromUDP(b)
+		if err != nil {
 			continue
 		} else if n == 3 && (string(b[:n]) == "ACK" || string(b[:n]) == "SYN") && t.Add(time.Millisecond * 200).After(time.Now()) {
 			continue
 		}
 
-		i, ok := m[p.String()]
-		from := fmt.Sprintf("Peer %d:", i)
+		from, ok := m[p.String()]
 		if !ok {
 			from = "Peer unknown:"
 		}
@@ -85,13 +104,21 @@ func (c chat) receive() {
 	}
 }
 
+func (c chat) events() {
+	for e := range c.session.Events {
+		if e.Type == client.EventPeerLeft {
+			log.Println("Peer", e.Peer.Addr, "left.")
+		}
+	}
+}
+
 func (c chat) send() {
 	scanner := bufio.NewScanner(os.Stdin)
 
 	for scanner.Scan() {
 		msg := scanner.Text()
-		for _, addr := range c.addrs {
-			c.socket.WriteToUDP([]byte(msg), addr)
+		for _, peer := range c.peers {
+			c.socket.WriteToUDP([]byte(msg), peer.Addr)
 		}
 
 		log.Println("Me:", msg)
@@ -99,11 +126,17 @@ func (c chat) send() {
 }
 
 func (c chat) keepAlive() {
+	keepAlive, err := protocol.Marshal(protocol.Message{Type: protocol.TypeKeepAlive})
+	if err != nil {
+		log.Println("Could not encode keep alive packet:", err)
+		return
+	}
+
 	for {
 		select {
 		case <-time.After(c.keepAlivePeriod):
-			for _, addr := range c.addrs {
-				c.socket.WriteToUDP([]byte{}, addr)
+			for _, peer := range c.peers {
+				c.socket.WriteToUDP(keepAlive, peer.Addr)
 			}
 		}
 	}
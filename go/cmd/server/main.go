@@ -1,9 +1,15 @@
 package main
 
 import (
+    "context"
+    "errors"
     "github.com/4kills/hole-punching/go/pkg/server"
     "github.com/go-logr/stdr"
+    "log"
     "os"
+    "os/signal"
+    "syscall"
+    "time"
 )
 
 func main() {
@@ -19,5 +25,23 @@ func main() {
 
     stdr.SetVerbosity(1)
 
-    s.ListenAndServe()
-}
\ No newline at end of file
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        stop := make(chan os.Signal, 1)
+        signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+        <-stop
+
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        defer cancel()
+        if err := s.Shutdown(ctx); err != nil {
+            log.Println("could not shut down gracefully:", err)
+            s.Close()
+        }
+    }()
+
+    if err := s.ListenAndServe(); !errors.Is(err, server.ErrServerClosed) {
+        log.Fatal(err)
+    }
+    <-stopped // ListenAndServe returns as soon as the shutdown begins
+}
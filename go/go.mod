@@ -3,6 +3,13 @@ module github.com/4kills/hole-punching/go
 go 1.16
 
 require (
-	github.com/go-logr/logr v1.2.0
-	github.com/go-logr/stdr v1.2.0
+	// go.opentelemetry.io/otel v1.7.0 requires at least logr v1.2.3 and stdr v1.2.2
+	github.com/go-logr/logr v1.2.3
+	github.com/go-logr/stdr v1.2.2
+	github.com/gorilla/websocket v1.5.0
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/client_model v0.2.0
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 )
@@ -1,33 +1,113 @@
 package client
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"go.opentelemetry.io/otel/trace"
 	"net"
 	"os"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const network = "udp"
 
+// secretLen is the length of the secrets assigned by New.
+const secretLen = 16
+
+// resyncPeriod is the delay between the registrations repeated after the server has answered until all peers are known.
+const resyncPeriod = time.Second
+
+// UUID is the persistent identity of a client.
+type UUID = protocol.UUID
+
+// Peer is another client of the same domain, identified by its persistent ID and reachable at its endpoint Addr.
+// Peer.Metadata holds the metadata the peer registered with. The ID of peers registered through the legacy protocol
+// is zero.
+type Peer = protocol.Peer
+
+// DomainInfo is the state of a domain as returned by Query.
+type DomainInfo = protocol.DomainInfo
+
+// Role is the role of a client in a star domain, see client.Role.
+type Role = protocol.Role
+
+const (
+	// RoleNone makes the client a member of a full mesh domain. It is the default.
+	RoleNone = protocol.RoleNone
+	// RoleHost makes the client the host of a star domain. It learns about and connects to all guests.
+	RoleHost = protocol.RoleHost
+	// RoleGuest makes the client a guest of a star domain. It only learns about and connects to the host.
+	RoleGuest = protocol.RoleGuest
+)
+
 type client struct {
 	// Timeout sets the duration after which Connect will time out and return with an error. If the value is negative,
 	// Connect will never time out.
 	Timeout time.Duration
 
-	// MediatorServerRetryPeriod sets the delay between each ping to the server.
+	// MediatorServerRetryPeriod sets the delay between each registration attempt until the server has responded. If
+	// the server advertises a longer retry period to stay below its rate limit, that one is used instead.
 	MediatorServerRetryPeriod time.Duration
 	// PeerRetryPeriod sets the delay between each packet being sent to a remote
 	PeerRetryPeriod			  time.Duration
+	// HeartbeatPeriod sets the delay between the heartbeats sent to the server while connecting. If the server
+	// advertises a shorter heartbeat interval, that one is used instead, so the client is not evicted from its domain.
+	HeartbeatPeriod           time.Duration
 	// Socket represents the instance (LADDR:LPORT) used to establish the connections. THIS SOCKET HAS TO BE USED
 	// FOR FURTHER COMMUNICATION.
 	Socket                    *net.UDPConn
+	// ID identifies this client towards the server and the other peers independently of its endpoint. New assigns a
+	// random ID. Persist and restore it to be recognized as the same peer after a restart.
+	ID UUID
+	// Secret proves towards the server that this client owns ID, so that it may replace the endpoint of ID after a
+	// restart changed its endpoint. New assigns a random secret. Persist and restore it together with ID and do not
+	// hand it to others.
+	Secret []byte
+	// Token is the join token attached to the registration. It is only needed if the server requires authorization,
+	// in which case it must be issued for the id passed to Connect. See package token.
+	Token string
+	// APIKey identifies the product this client belongs to if the server is shared by several tenants. It is attached
+	// to every message referring to a domain. Servers without tenants ignore it.
+	APIKey string
+	// Legacy makes the client speak the unframed text protocol of older rendezvous servers, i.e. it sends the raw
+	// id and expects a comma-joined list of addresses.
+	Legacy bool
+	// Metadata is attached to the registration and handed to the other peers alongside the endpoint of this client,
+	// e.g. a display name, public key or protocol version. The server limits its size (256 bytes by default).
+	// Legacy servers do not support metadata.
+	Metadata []byte
+	// Role selects the topology of the domain. By default, all members connect to each other. If members register
+	// as RoleHost or RoleGuest, the domain is a star instead: guests only learn about and connect to the single host,
+	// so their endpoints are not exposed to each other. A domain cannot mix both kinds of members.
+	Role Role
+	// KeepRegistered makes a successful Connect stay registered with the server, so that the server keeps pushing
+	// changes of the domain as Session.Events. The client keeps sending heartbeats until Session.Close is called.
+	// It has no effect for Legacy clients.
+	KeepRegistered bool
+	// WebSocketURL is the URL of the WebSocket transport of the server, e.g. wss://example.com/ws. If it is set and
+	// the server does not answer any registration sent over UDP within WebSocketFallback, Connect registers over
+	// WebSocket instead, e.g. if outbound UDP to the server is blocked. The peers are still connected over UDP.
+	// Legacy servers do not support WebSocket.
+	WebSocketURL      string
+	WebSocketFallback time.Duration
+	// TracerProvider creates the OpenTelemetry spans of Connect, ConnectPeers and their steps. The trace context is
+	// sent along with the registration, so the spans of the server belong to the same trace. If it is nil, the global
+	// provider is used, which does not record anything unless set with otel.SetTracerProvider.
+	TracerProvider trace.TracerProvider
 
 	wellKnownHost         *net.UDPAddr
 	readDeadline	      time.Time
+	// params caches the parameters advertised by the server across connects.
+	params                *serverParams
+	signals               chan Signal
+	link                  *serverLink
 }
 
 // New returns a new client used to establish peer connections through the wellKnownHost. After connection, you
@@ -37,6 +117,21 @@ func New(wellKnownHost string) (client, error) {
 		Timeout:                   40 * time.Second,
 		MediatorServerRetryPeriod: 100 * time.Millisecond,
 		PeerRetryPeriod: 		   100 * time.Millisecond,
+		HeartbeatPeriod:           10 * time.Second,
+		WebSocketFallback:         5 * time.Second,
+		params:                    &serverParams{},
+		signals:                   make(chan Signal, signalBuffer),
+		link:                      &serverLink{},
+	}
+
+	id, err := protocol.NewUUID()
+	if err != nil {
+		return c, err
+	}
+	c.ID = id
+	c.Secret = make([]byte, secretLen)
+	if _, err := rand.Read(c.Secret); err != nil {
+		return c, err
 	}
 
 	s, err := net.ListenUDP(network, &net.UDPAddr{})
@@ -54,121 +149,425 @@ func New(wellKnownHost string) (client, error) {
 	return c, err
 }
 
-// Connect returns all connected peers (i.e. their respective UDPAddr) as well as the UDPConn used for connection.
+// Connect returns a Session holding all connected peers (i.e. their respective ID and UDPAddr), the UDPConn used for
+// connection and the public endpoint of this client as seen by the server.
 // You MUST use this UDPConn for further communication. This is the same as client.Socket.
 //
 // Connect uses id to identify peers trying to connect through the same id. Expected is the number of peers expected to connect.
+// For a client.Role of RoleHost this is the number of guests, for RoleGuest it is 1, the host.
 // When expected numbers of peers have connected this method returns with a nil error. When not all peers connect in client.Timeout
-// an ErrTimeoutDuringPeerConnect (wrapping os.ErrDeadlineExceeded) will be returned. However, the returned UPDAddr might still be of use.
+// an ErrTimeoutDuringPeerConnect (wrapping os.ErrDeadlineExceeded) will be returned. However, the returned peers might still be of use.
 //
 // If the client times out during attempting to connect to the server (server not available) or if not expected number of peers have reached
-// the server yet, the method will return ErrTimeoutDuringServerConnect (wrapping os.ErrDeadlineExceeded) with []UDPAddr containing all addr so far.
+// the server yet, the method will return ErrTimeoutDuringServerConnect (wrapping os.ErrDeadlineExceeded) with Session.Peers containing all peers so far.
 // You may then try to connect with these peers using ConnectPeers.
-func (c client) Connect(id []byte, expected int) ([]*net.UDPAddr, *net.UDPConn , error) {
+//
+// If connecting fails or is canceled, Connect leaves the domain at the server (see Leave) before returning. Otherwise
+// it tells the server that it is done unless client.KeepRegistered is set, which deregisters the client without
+// notifying the peers, as they are connected to it. Either way, the read deadline of the socket is reset. Peers which
+// leave the domain while connecting are dropped from Session.Peers.
+func (c client) Connect(id []byte, expected int) (Session, error) {
+	return c.ConnectContext(context.Background(), id, expected)
+}
+
+// ConnectContext is like Connect but gives up as soon as ctx is done, in which case the returned error wraps ctx.Err().
+// The spans of the connect belong to the trace of ctx, if any.
+func (c client) ConnectContext(ctx context.Context, id []byte, expected int) (Session, error) {
+	ctx, span := c.tracer().Start(ctx, "client.Connect", trace.WithAttributes(attrDomain.String(string(id)), attrPeers.Int(expected)))
+	session, err := c.connect(ctx, id, expected)
+	span.SetAttributes(attrIndex.Int(session.Index), attrPeers.Int(len(session.Peers)))
+	endSpan(span, err)
+
+	return session, err
+}
+
+// connect implements ConnectContext.
+func (c client) connect(ctx context.Context, id []byte, expected int) (Session, error) {
 	if c.Timeout >= 0 {
 		c.readDeadline = time.Now().Add(c.Timeout)
 		err := c.Socket.SetReadDeadline(c.readDeadline)
 		if err != nil {
-			return nil, nil, err
+			return Session{}, err
 		}
 	}
+	defer c.Socket.SetReadDeadline(time.Time{})
 
-	remConns, err := c.connectToServer(id, expected)
+	// unblock pending reads once ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <- ctx.Done():
+			c.Socket.SetReadDeadline(time.Now())
+		case <- done:
+		}
+	}()
+
+	stopHeartbeats := make(chan struct{})
+	go c.sendHeartbeats(id, stopHeartbeats)
+
+	session, err := c.connectToServer(ctx, id, expected)
+	if errors.Is(err, errUDPUnresponsive) && ctx.Err() == nil {
+		if err = c.link.open(ctx, c.WebSocketURL, c.Socket, c.wellKnownHost); err == nil {
+			session, err = c.connectToServer(ctx, id, expected)
+		}
+	}
+	if err == nil {
+		var left []Peer
+		left, err = c.connectPeers(ctx, session.Peers, session.Index)
+		session.Peers = removePeers(session.Peers, left)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %v", ctx.Err(), err)
+	}
+
+	session.Socket = c.Socket
+	session.server = c.wellKnownHost
+	session.relay = c.link.relayAddr()
+	session.Role = c.Role
+	session.KeepAlivePeriod = c.params.keepAlivePeriod()
+	if err == nil && c.KeepRegistered && !c.Legacy {
+		session.watch = newWatch(c, id, stopHeartbeats)
+		session.Events = session.watch.events
+		return session, nil
+	}
+
+	close(stopHeartbeats)
 	if err != nil {
-		return remConns, c.Socket, err
+		c.Leave(id)
+	} else {
+		c.deregister(id, protocol.TypeDone)
 	}
+	c.link.close()
+	return session, err
+}
 
-	err = c.ConnectPeers(remConns)
+// sendHeartbeats signals the presence of the client in domain id to the server until done is closed.
+func (c client) sendHeartbeats(id []byte, done <-chan struct{}) {
+	if c.Legacy {
+		return
+	}
+
+	heartbeat, err := protocol.Marshal(protocol.Message{Type: protocol.TypeHeartbeat, Domain: id, ClientID: c.ID, APIKey: c.APIKey})
+	if err != nil {
+		return
+	}
 
-	return remConns, c.Socket, err
+	for {
+		select {
+		case <- done:
+			return
+		case <- time.After(c.params.heartbeatPeriod(c.HeartbeatPeriod)):
+			if err := c.sendToServer(heartbeat); err != nil {
+				return
+			}
+		}
+	}
 }
 
-func (c client) connectToServer(id []byte, expected int) ([]*net.UDPAddr, error)  {
-	var remConns []*net.UDPAddr
+// Leave deregisters the client from domain id at the server. The server then immediately stops listing the client as
+// a peer, stops sending keep alive packets to it and notifies the remaining peers. Connect only leaves on its own if
+// it fails, so call Leave once you no longer need the server, e.g. after ConnectPeers. Leave does nothing for Legacy
+// clients.
+func (c client) Leave(id []byte) error {
+	return c.deregister(id, protocol.TypeLeave)
+}
+
+// deregister sends a message of type typ, i.e. TypeLeave or TypeDone, to deregister from domain id at the server.
+func (c client) deregister(id []byte, typ protocol.Type) error {
+	if c.Legacy {
+		return nil
+	}
+
+	msg, err := protocol.Marshal(protocol.Message{Type: typ, Domain: id, ClientID: c.ID, APIKey: c.APIKey})
+	if err != nil {
+		return err
+	}
+
+	return c.sendToServer(msg)
+}
+
+// Query returns the state of domain id, e.g. to list lobbies filling up, without joining it. The peers of the domain
+// are only returned if client.Token authorizes the domain, otherwise they are nil.
+//
+// Query retries every client.MediatorServerRetryPeriod until the server answers or client.Timeout has passed, in
+// which case ErrTimeoutDuringServerConnect is returned. It must not be called concurrently with Connect, as both read
+// from client.Socket. Legacy servers cannot be queried and ErrLegacyUnsupported is returned.
+func (c client) Query(id []byte) (DomainInfo, []Peer, error) {
+	if c.Legacy {
+		return DomainInfo{}, nil, ErrLegacyUnsupported
+	}
+
+	query, err := protocol.Marshal(protocol.Message{Type: protocol.TypeQuery, Domain: id, ClientID: c.ID, Token: c.Token, APIKey: c.APIKey})
+	if err != nil {
+		return DomainInfo{}, nil, err
+	}
+	defer c.Socket.SetReadDeadline(time.Time{})
+
+	deadline := time.Now().Add(c.Timeout)
 	readBuffer := make([]byte, 0xffff)
+	for {
+		if err := c.sendToServer(query); err != nil {
+			return DomainInfo{}, nil, err
+		}
 
-	chanErr := make(chan error, 1)
-	defer close(chanErr)
+		retry := time.Now().Add(c.params.retryPeriod(c.MediatorServerRetryPeriod))
+		if c.Timeout >= 0 && retry.After(deadline) {
+			retry = deadline
+		}
+		if err := c.Socket.SetReadDeadline(retry); err != nil {
+			return DomainInfo{}, nil, err
+		}
+
+		for {
+			n, inboundAddr, err := c.Socket.ReadFromUDP(readBuffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			} else if err != nil {
+				return DomainInfo{}, nil, err
+			}
+			if !c.isServer(inboundAddr) {
+				continue
+			}
+
+			msg, err := c.parse(readBuffer[:n])
+			if err != nil {
+				return DomainInfo{}, nil, err
+			}
+			if msg.Type != protocol.TypeDomainInfo || !bytes.Equal(msg.Domain, id) || msg.Info == nil {
+				continue
+			}
+			return *msg.Info, sortPeers(msg.Peers), nil
+		}
+
+		if c.Timeout >= 0 && !time.Now().Before(deadline) {
+			return DomainInfo{}, nil, fmt.Errorf("%w: timeout after %s while querying domain", ErrTimeoutDuringServerConnect, c.Timeout.String())
+		}
+	}
+}
+
+func (c client) connectToServer(ctx context.Context, id []byte, expected int) (session Session, err error)  {
+	transport := "udp"
+	if c.link.relayAddr() != nil {
+		transport = "websocket"
+	}
+	ctx, span := c.tracer().Start(ctx, "client.connectToServer", trace.WithAttributes(attrTransport.String(transport)))
+	var attempts int64
+	defer func() {
+		span.SetAttributes(attrAttempts.Int64(atomic.LoadInt64(&attempts)), attrPeers.Int(len(session.Peers)))
+		endSpan(span, err)
+	}()
+
+	readBuffer := make([]byte, 0xffff)
+
+	// guests do not know the size of a star domain
+	size := expected + 1
+	if c.Role == RoleGuest {
+		size = 0
+	}
+
+	registration := id
+	if !c.Legacy {
+		var err error
+		registration, err = protocol.Marshal(protocol.Message{
+			Type:     protocol.TypeRegister,
+			Domain:   id,
+			ClientID: c.ID,
+			Token:    c.Token,
+			Secret:   c.Secret,
+			APIKey:   c.APIKey,
+			Role:     c.Role,
+			Metadata: c.Metadata,
+			Size:     size,
+			TraceParent: traceParent(ctx),
+		})
+		if err != nil {
+			return session, err
+		}
+	}
+	if err := c.params.fits(registration); err != nil {
+		return session, err
+	}
 
+	// if the transport can fall back to WebSocket, the server has to answer over UDP within client.WebSocketFallback
+	fallback := c.WebSocketURL != "" && !c.Legacy && c.link.relayAddr() == nil
+	if fallback {
+		fallbackDeadline := time.Now().Add(c.WebSocketFallback)
+		if c.Timeout >= 0 && !fallbackDeadline.Before(c.readDeadline) {
+			fallback = false
+		} else if err := c.Socket.SetReadDeadline(fallbackDeadline); err != nil {
+			return session, err
+		}
+	}
+
+	chanErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	registered := make(chan struct{})
+	isRegistered := false
+
+	// The server pushes every newly registered peer to us, so once it has answered, registration is only repeated
+	// every resyncPeriod. Each registration is answered with the current peers, so a lost push does not stall us until
+	// client.Timeout. Legacy servers do not push and have to be polled until all peers are known.
 	go func() {
 		for {
-			select {
-			case <- chanErr:
+			atomic.AddInt64(&attempts, 1)
+			err := c.sendToServer(registration)
+			if err != nil {
+				chanErr <- err
 				return
-			default:
-				_, err := c.Socket.WriteToUDP(id, c.wellKnownHost)
-				if err != nil {
-					chanErr <- err
-					return
-				}
+			}
 
-				time.Sleep(c.MediatorServerRetryPeriod)
+			period := c.MediatorServerRetryPeriod
+			select {
+			case <- registered:
+				period = resyncPeriod
+			default:
+			}
+			select {
+			case <- stop:
+				return
+			case <- time.After(c.params.retryPeriod(period)):
 			}
 		}
 	}()
 
-	foundPeers := 0
 	for {
 		select {
 		case err := <- chanErr:
-			return nil, err
+			return session, err
 		default:
 			n, inboundAddr, err := c.Socket.ReadFromUDP(readBuffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) && fallback && ctx.Err() == nil {
+				if err := c.Socket.SetReadDeadline(c.readDeadline); err != nil {
+					return session, err
+				}
+				return session, errUDPUnresponsive
+			}
 			if errors.Is(err, os.ErrDeadlineExceeded) {
-				return remConns, fmt.Errorf("%w: timeout after %s with %d peers found: %v", ErrTimeoutDuringServerConnect, c.Timeout.String(), foundPeers, err)
+				return session, fmt.Errorf("%w: timeout after %s with %d peers found: %v", ErrTimeoutDuringServerConnect, c.Timeout.String(), len(session.Peers), err)
 			} else if err != nil {
-				return nil, err
+				return session, err
 			}
 			if n == 0 { // possibly keep alive packet
 				continue
 			}
 
-			if inboundAddr.String() != c.wellKnownHost.String() {
+			if !c.isServer(inboundAddr) {
 				continue
 			}
+			if fallback { // the server answers over UDP
+				fallback = false
+				if err := c.Socket.SetReadDeadline(c.readDeadline); err != nil {
+					return session, err
+				}
+				if ctx.Err() != nil {
+					c.Socket.SetReadDeadline(time.Now())
+				}
+			}
 
-			remConns, err = parse(readBuffer[:n])
+			msg, err := c.parse(readBuffer[:n])
+			if msg.Params != nil {
+				c.params.set(*msg.Params)
+			}
+			if errors.Is(err, ErrNotRegistered) { // evicted, e.g. because heartbeats got lost
+				if err := c.sendToServer(registration); err != nil {
+					return session, err
+				}
+				continue
+			}
 			if err != nil {
-				return nil, err
+				return session, err
 			}
 
-			foundPeers = len(remConns)
-			if foundPeers == expected {
-				return remConns, nil
+			if msg.Reflexive != nil {
+				session.Reflexive = msg.Reflexive
+			}
+			if msg.Index > 0 {
+				session.Index = msg.Index
+			}
+
+			switch msg.Type {
+			case protocol.TypePeers:
+				if !c.Legacy && !isRegistered {
+					close(registered)
+					isRegistered = true
+				}
+			case protocol.TypePeerJoined:
+			case protocol.TypePeerLeft:
+				session.Peers = removePeers(session.Peers, msg.Peers)
+				continue
+			case protocol.TypeSignal:
+				c.deliver(msg)
+				continue
+			case protocol.TypeProbe: // the server checks that the probe sent over UDP came from us
+				if err := c.returnChallenge(msg); err != nil {
+					return session, err
+				}
+				continue
+			case protocol.TypeReady: // the server has seen all peers
+				session.Peers = sortPeers(msg.Peers)
+				return session, nil
+			default:
+				continue
+			}
+
+			// a push may overtake the response to our registration, hence both are merged
+			session.Peers = sortPeers(mergePeers(session.Peers, msg.Peers))
+			if len(session.Peers) == expected {
+				return session, nil
 			}
 		}
 	}
 }
 
 // ConnectPeers should only be used after a preceding Connect has been called and timed out with ErrTimeoutDuringServerConnect.
-// This method then allows for trying to connect to remConns (returned by Connect). The method returns ErrTimeoutDuringPeerConnect
+// This method then allows for trying to connect to remConns (Session.Peers returned by Connect). The method returns ErrTimeoutDuringPeerConnect
 // if not all peers respond properly.
 //
 // This method will refresh the timeout (as it should only be called after Connect has timed out).
 // Consider this when configuring the timeout of the server.
-func (c client) ConnectPeers(remConns []*net.UDPAddr) error {
+//
+// Peers which the server reports to have left the domain are no longer waited for.
+func (c client) ConnectPeers(remConns []Peer) error {
+	_, err := c.connectPeers(context.Background(), remConns, 0)
+	return err
+}
+
+// connectPeers implements ConnectPeers and additionally returns the peers which left the domain meanwhile. index is
+// the index of the client in its domain, see Session.Initiates. The span of the connect is a child of the span of
+// parent, which does not cancel the connect.
+func (c client) connectPeers(parent context.Context, remConns []Peer, index int) (left []Peer, err error) {
+	parent, span := c.tracer().Start(parent, "client.ConnectPeers", trace.WithAttributes(attrPeers.Int(len(remConns))))
+	defer func() {
+		span.SetAttributes(attrLeft.Int(len(left)))
+		endSpan(span, err)
+	}()
+
+	session := Session{Index: index}
 	connectionsBuffer := 16
 
 	if c.readDeadline.Before(time.Now()) && c.Timeout >= 0 {
 		c.readDeadline = time.Now().Add(c.Timeout)
 		if err := c.Socket.SetReadDeadline(c.readDeadline); err != nil {
-			return err
+			return left, err
 		}
 	}
 
 	readBuffer := make([]byte, 0xffff)
 	remotes := make(map[string]chan string)
+	heard := make(map[string]bool)
 	cErr := make(chan error)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(parent)))
 	wg := &sync.WaitGroup{}
 	defer cancel()
 
 	for _, peer := range remConns {
 		ch := make(chan string, connectionsBuffer)
-		remotes[peer.String()] = ch
+		remotes[peer.Addr.String()] = ch
 		wg.Add(1)
-		go c.connectIndividual(peer, ch, cErr, ctx, cancel, wg)
+		go c.connectIndividual(peer.Addr, session.Initiates(peer), ch, cErr, ctx, cancel, wg)
 	}
 
 	cWait := make(chan struct{})
@@ -180,31 +579,69 @@ func (c client) ConnectPeers(remConns []*net.UDPAddr) error {
 	for {
 		select {
 		case <- cWait:
-			return nil
+			return left, nil
 		case err := <- cErr:
-			return err
+			return left, err
 		default:
 			n, inbound, err := c.Socket.ReadFromUDP(readBuffer)
 			if errors.Is(err, os.ErrDeadlineExceeded) {
-				return fmt.Errorf("%w: timeout after %s: %v", ErrTimeoutDuringPeerConnect, c.Timeout.String(), err)
+				return left, fmt.Errorf("%w: timeout after %s: %v", ErrTimeoutDuringPeerConnect, c.Timeout.String(), err)
 			} else if err != nil {
-				return err
+				return left, err
 			}
-			if n == 0 { // keep alive packet
+			if n == 0 || protocol.IsKeepAlive(readBuffer[:n]) {
 				continue
 			}
 
-			remotes[inbound.String()] <- string(readBuffer[:n])
+			if !c.Legacy && c.isServer(inbound) {
+				msg, err := c.parse(readBuffer[:n])
+				if err == nil && msg.Type == protocol.TypeSignal {
+					c.deliver(msg)
+				}
+				if err != nil || msg.Type != protocol.TypePeerLeft {
+					continue
+				}
+				// stop waiting for departed peers. Peers which have been heard of leave after connecting to us.
+				for _, peer := range msg.Peers {
+					if ch, ok := remotes[peer.Addr.String()]; ok && !heard[peer.Addr.String()] {
+						close(ch)
+						delete(remotes, peer.Addr.String())
+						left = append(left, peer)
+					}
+				}
+				continue
+			}
+
+			ch, ok := remotes[inbound.String()]
+			if !ok { // e.g. a late response of the server
+				continue
+			}
+			heard[inbound.String()] = true
+			ch <- string(readBuffer[:n])
 		}
 	}
 }
 
-func (c client) connectIndividual(peer *net.UDPAddr, ch chan string, cErr chan error, ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup) {
+// connectIndividual punches a hole to peer. The initiator sends its first SYN immediately, while the responder
+// waits for one retry period, so the SYN of the initiator is likely to be answered with an ACK right away. The
+// responder still sends SYNs afterwards to open its own NAT mapping.
+func (c client) connectIndividual(peer *net.UDPAddr, initiator bool, ch chan string, cErr chan error, ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup) {
+	_, span := c.tracer().Start(ctx, "client.connectIndividual", trace.WithAttributes(attrPeer.String(peer.String()), attrInitiator.Bool(initiator)))
+	attempts := 0
+	outcome := outcomeCanceled
+	defer func() {
+		span.SetAttributes(attrAttempts.Int(attempts), attrOutcome.String(outcome))
+		span.End()
+	}()
+
 	syn := "SYN"
 	ack := "ACK"
 
 	msg := syn
 	retryPeriod := time.Duration(0)
+	if !initiator {
+		retryPeriod = c.PeerRetryPeriod
+	}
 
 	send := func() {
 		_, err := c.Socket.WriteToUDP([]byte(msg), peer)
@@ -218,7 +655,12 @@ func (c client) connectIndividual(peer *net.UDPAddr, ch chan string, cErr chan e
 		select {
 		case <- ctx.Done():
 			return
-		case str := <- ch:
+		case str, ok := <- ch:
+			if !ok { // the peer left
+				outcome = outcomeLeft
+				wg.Done()
+				return
+			}
 			if str == syn {
 				msg = ack
 			} else if str == ack {
@@ -228,27 +670,81 @@ func (c client) connectIndividual(peer *net.UDPAddr, ch chan string, cErr chan e
 					time.Sleep(delay)
 					send()
 				}(c.PeerRetryPeriod)
+				outcome = outcomeOK
 				wg.Done()
 				return
 			}
 		case <-time.After(retryPeriod):
 			retryPeriod = c.PeerRetryPeriod
+			attempts++
 			send()
 		}
 	}
 }
 
-func parse(content []byte) ([]*net.UDPAddr, error) {
-	rawAddrs := strings.Split(string(content), ",")
-	ret := make([]*net.UDPAddr, len(rawAddrs))
+// parse decodes a message of the server. Legacy responses are returned as protocol.TypePeers messages and error
+// messages are returned as error.
+func (c client) parse(content []byte) (protocol.Message, error) {
+	if c.Legacy {
+		peers, err := protocol.DecodeLegacyPeers(content)
+		return protocol.Message{Type: protocol.TypePeers, Peers: peers}, err
+	}
 
-	for i, v := range rawAddrs {
-		addr, err := net.ResolveUDPAddr(network, v)
-		if err != nil {
-			return ret, err
+	msg, err := protocol.Unmarshal(content)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Type == protocol.TypeError {
+		return msg, fmt.Errorf("%w: %s", errorFromCode(msg.Code), msg.Reason)
+	}
+
+	return msg, nil
+}
+
+// mergePeers merges add into peers. A peer of add replaces the peer of peers with the same ID, e.g. because it
+// restarted and registered with a new endpoint. Peers without ID are identified by their endpoint.
+func mergePeers(peers, add []Peer) []Peer {
+	for _, a := range add {
+		known := false
+		for i, p := range peers {
+			if !a.ID.IsZero() && a.ID == p.ID || a.Addr.String() == p.Addr.String() {
+				peers[i] = a
+				known = true
+				break
+			}
+		}
+		if !known {
+			peers = append(peers, a)
 		}
-		ret[i] = addr
 	}
 
-	return ret, nil
+	return peers
+}
+
+// removePeers returns peers without the peers of remove. Peers are identified like in mergePeers.
+func removePeers(peers, remove []Peer) []Peer {
+	kept := peers[:0]
+	for _, p := range peers {
+		removed := false
+		for _, r := range remove {
+			if !r.ID.IsZero() && r.ID == p.ID || r.Addr.String() == p.Addr.String() {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, p)
+		}
+	}
+
+	return kept
+}
+
+// sortPeers sorts peers by their index. The order of peers without index is kept.
+func sortPeers(peers []Peer) []Peer {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return peers[i].Index < peers[j].Index
+	})
+
+	return peers
 }
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+// fakeServer answers registrations with the endpoints of the clients registered so far, but never pushes newly
+// registered clients to the others, as if all pushes got lost.
+func fakeServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		var registered []Peer
+		buf := make([]byte, 0xffff)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := protocol.Unmarshal(buf[:n])
+			if err != nil || msg.Type != protocol.TypeRegister {
+				continue
+			}
+
+			var others []Peer
+			known := false
+			for _, p := range registered {
+				if p.ID == msg.ClientID {
+					known = true
+					continue
+				}
+				others = append(others, p)
+			}
+			if !known {
+				registered = append(registered, Peer{ID: msg.ClientID, Addr: addr})
+			}
+
+			answer, err := protocol.Marshal(protocol.Message{Type: protocol.TypePeers, Peers: others})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.WriteToUDP(answer, addr)
+		}
+	}()
+	return conn
+}
+
+func TestClient_Connect_LostPush(t *testing.T) {
+	server := fakeServer(t)
+
+	clients := make([]client, 2)
+	for i := range clients {
+		var err error
+		if clients[i], err = New(server.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		clients[i].Timeout = 5 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(c client) {
+			defer wg.Done()
+			session, err := c.Connect([]byte("lost"), 1)
+			if err != nil {
+				t.Error(err)
+			} else if len(session.Peers) != 1 {
+				t.Errorf("got %v\n want %d peer", session.Peers, 1)
+			}
+		}(c)
+
+		// the first client is answered before the second one registers
+		if i == 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+}
+
+func TestServerParams(t *testing.T) {
+	tt := []struct {
+		name          string
+		params        *protocol.Params
+		registration  int
+		wantFits      error
+		wantRetry     time.Duration
+		wantHeartbeat time.Duration
+		wantKeepAlive time.Duration
+	}{
+		{name: "not advertised", registration: 2048, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "registration fits", params: &protocol.Params{MaxPacketSize: 64}, registration: 64, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "id too long", params: &protocol.Params{MaxPacketSize: 64}, registration: 65, wantFits: ErrIDTooLong, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "longer retry period", params: &protocol.Params{RetryPeriod: time.Second}, wantRetry: time.Second, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "shorter retry period", params: &protocol.Params{RetryPeriod: 10 * time.Millisecond}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "shorter heartbeat interval", params: &protocol.Params{HeartbeatInterval: 3 * time.Second}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 3 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "longer heartbeat interval", params: &protocol.Params{HeartbeatInterval: 30 * time.Second}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: defaultKeepAlivePeriod},
+		{name: "keep alive interval", params: &protocol.Params{KeepAliveInterval: 2 * time.Second, MemberTTL: 30 * time.Second}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: 2 * time.Second},
+		{name: "keep alive interval beyond member ttl", params: &protocol.Params{KeepAliveInterval: 20 * time.Second, MemberTTL: 10 * time.Second}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: 5 * time.Second},
+		{name: "default keep alive beyond member ttl", params: &protocol.Params{MemberTTL: 4 * time.Second}, wantRetry: 100 * time.Millisecond, wantHeartbeat: 10 * time.Second, wantKeepAlive: 2 * time.Second},
+	}
+
+	for _, tc := range tt {
+		s := &serverParams{}
+		if tc.params != nil {
+			s.set(*tc.params)
+		}
+
+		if err := s.fits(make([]byte, tc.registration)); !errors.Is(err, tc.wantFits) {
+			t.Errorf("%s: got %v\n want %v", tc.name, err, tc.wantFits)
+		}
+		if got := s.retryPeriod(100 * time.Millisecond); got != tc.wantRetry {
+			t.Errorf("%s: got retry period %v\n want %v", tc.name, got, tc.wantRetry)
+		}
+		if got := s.heartbeatPeriod(10 * time.Second); got != tc.wantHeartbeat {
+			t.Errorf("%s: got heartbeat period %v\n want %v", tc.name, got, tc.wantHeartbeat)
+		}
+		if got := s.keepAlivePeriod(); got != tc.wantKeepAlive {
+			t.Errorf("%s: got keep alive period %v\n want %v", tc.name, got, tc.wantKeepAlive)
+		}
+	}
+}
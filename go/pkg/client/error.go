@@ -1,11 +1,70 @@
 package client
 
 import (
+	"errors"
 	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
 	"os"
 )
 
 var (
 	ErrTimeoutDuringServerConnect = fmt.Errorf("%w: timeout during attempting to establish a connection to mediator server", os.ErrDeadlineExceeded)
 	ErrTimeoutDuringPeerConnect = fmt.Errorf("%w: timeout during attempting to establish a peer to peer network", os.ErrDeadlineExceeded)
+	ErrRejectedByServer = errors.New("rejected by mediator server")
+	ErrUnauthorized = fmt.Errorf("%w: unauthorized, the join token is missing, invalid or expired", ErrRejectedByServer)
+	ErrDomainFull = fmt.Errorf("%w: domain has reached its maximum number of members", ErrRejectedByServer)
+	ErrDomainSealed = fmt.Errorf("%w: domain is complete and does not admit new peers", ErrRejectedByServer)
+	ErrSizeMismatch = fmt.Errorf("%w: expected number of peers differs from the other peers of the domain", ErrRejectedByServer)
+	ErrMalformedMessage = fmt.Errorf("%w: server could not decode message", ErrRejectedByServer)
+	ErrUnsupportedVersion = fmt.Errorf("%w: server does not support protocol version", ErrRejectedByServer)
+	ErrPacketTooLarge = fmt.Errorf("%w: packet exceeds maximum packet size of server, the id might be too long", ErrRejectedByServer)
+	ErrStoreFailure = fmt.Errorf("%w: server could not store registration", ErrRejectedByServer)
+	ErrRateLimited = fmt.Errorf("%w: too many packets sent to server", ErrRejectedByServer)
+	ErrNotRegistered = fmt.Errorf("%w: client is not registered with the domain", ErrRejectedByServer)
+	ErrRoleConflict = fmt.Errorf("%w: role conflicts with domain, e.g. it already has a host", ErrRejectedByServer)
+	ErrMetadataTooLarge = fmt.Errorf("%w: metadata exceeds maximum metadata size of server", ErrRejectedByServer)
+	ErrNotProvisioned = fmt.Errorf("%w: domain has not been provisioned by the backend or its provision has expired", ErrRejectedByServer)
+	ErrQuotaExceeded = fmt.Errorf("%w: quota of the tenant of the api key exceeded, e.g. its maximum number of domains", ErrRejectedByServer)
+	ErrIDInUse = fmt.Errorf("%w: client id is registered from another endpoint, its secret or a join token bound to it is needed to move it", ErrRejectedByServer)
+	ErrIDTooLong = errors.New("id too long for maximum packet size of server")
+	ErrLegacyUnsupported = errors.New("not supported by legacy servers")
 )
+
+// errorFromCode returns the error corresponding to the error code of a server response. All of them wrap
+// ErrRejectedByServer.
+func errorFromCode(code protocol.ErrorCode) error {
+	switch code {
+	case protocol.CodeUnauthorized:
+		return ErrUnauthorized
+	case protocol.CodeDomainFull:
+		return ErrDomainFull
+	case protocol.CodeDomainSealed:
+		return ErrDomainSealed
+	case protocol.CodeSizeMismatch:
+		return ErrSizeMismatch
+	case protocol.CodeMalformed:
+		return ErrMalformedMessage
+	case protocol.CodeUnsupportedVersion:
+		return ErrUnsupportedVersion
+	case protocol.CodePacketTooLarge:
+		return ErrPacketTooLarge
+	case protocol.CodeStoreFailure:
+		return ErrStoreFailure
+	case protocol.CodeRateLimited:
+		return ErrRateLimited
+	case protocol.CodeNotRegistered:
+		return ErrNotRegistered
+	case protocol.CodeRoleConflict:
+		return ErrRoleConflict
+	case protocol.CodeMetadataTooLarge:
+		return ErrMetadataTooLarge
+	case protocol.CodeQuotaExceeded:
+		return ErrQuotaExceeded
+	case protocol.CodeNotProvisioned:
+		return ErrNotProvisioned
+	case protocol.CodeIDInUse:
+		return ErrIDInUse
+	default:
+		return fmt.Errorf("%w: %s", ErrRejectedByServer, code.String())
+	}
+}
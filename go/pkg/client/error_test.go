@@ -0,0 +1,35 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+func TestErrorFromCode(t *testing.T) {
+	tt := []struct {
+		code protocol.ErrorCode
+		want error
+	}{
+		{code: protocol.CodeUnauthorized, want: ErrUnauthorized},
+		{code: protocol.CodeDomainFull, want: ErrDomainFull},
+		{code: protocol.CodeDomainSealed, want: ErrDomainSealed},
+		{code: protocol.CodePacketTooLarge, want: ErrPacketTooLarge},
+		{code: protocol.CodeStoreFailure, want: ErrStoreFailure},
+		{code: protocol.CodeRateLimited, want: ErrRateLimited},
+		{code: protocol.CodeRoleConflict, want: ErrRoleConflict},
+		{code: protocol.CodeMetadataTooLarge, want: ErrMetadataTooLarge},
+		{code: protocol.CodeQuotaExceeded, want: ErrQuotaExceeded},
+		{code: protocol.CodeNotProvisioned, want: ErrNotProvisioned},
+		{code: protocol.CodeIDInUse, want: ErrIDInUse},
+		{code: protocol.ErrorCode(0xffff), want: ErrRejectedByServer},
+	}
+
+	for _, tc := range tt {
+		err := errorFromCode(tc.code)
+		if !errors.Is(err, tc.want) || !errors.Is(err, ErrRejectedByServer) {
+			t.Errorf("got %v\n want %v", err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// defaultKeepAlivePeriod is the peer keep alive period used if the server did not advertise its parameters.
+const defaultKeepAlivePeriod = 5 * time.Second
+
+// serverParams holds the latest parameters advertised by the server. It is safe for concurrent use.
+type serverParams struct {
+	mutex  sync.Mutex
+	params *protocol.Params
+}
+
+func (s *serverParams) set(p protocol.Params) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.params = &p
+}
+
+// get returns the advertised parameters. All of them are zero if the server has not advertised them yet.
+func (s *serverParams) get() protocol.Params {
+	if s == nil {
+		return protocol.Params{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.params == nil {
+		return protocol.Params{}
+	}
+	return *s.params
+}
+
+// fits returns ErrIDTooLong if the registration exceeds the maximum packet size of the server.
+func (s *serverParams) fits(registration []byte) error {
+	max := s.get().MaxPacketSize
+	if max > 0 && len(registration) > max {
+		return fmt.Errorf("%w: registration of %d bytes exceeds %d bytes", ErrIDTooLong, len(registration), max)
+	}
+	return nil
+}
+
+// retryPeriod returns period, or the retry period of the server if it is longer.
+func (s *serverParams) retryPeriod(period time.Duration) time.Duration {
+	if p := s.get().RetryPeriod; p > period {
+		return p
+	}
+	return period
+}
+
+// heartbeatPeriod returns period, or the heartbeat interval of the server if it is shorter.
+func (s *serverParams) heartbeatPeriod(period time.Duration) time.Duration {
+	if p := s.get().HeartbeatInterval; p > 0 && p < period {
+		return p
+	}
+	return period
+}
+
+// keepAlivePeriod returns the period in which peers should send keep alive packets to each other. It follows the
+// keep alive interval of the server, which keeps the NAT mapping towards the server intact, and stays below the
+// time after which the server evicts members.
+func (s *serverParams) keepAlivePeriod() time.Duration {
+	p := s.get()
+
+	period := defaultKeepAlivePeriod
+	if p.KeepAliveInterval > 0 {
+		period = p.KeepAliveInterval
+	}
+	if p.MemberTTL > 0 && period >= p.MemberTTL {
+		period = p.MemberTTL / 2
+	}
+
+	return period
+}
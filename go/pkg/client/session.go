@@ -0,0 +1,181 @@
+package client
+
+import (
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+// eventBuffer is the capacity of Session.Events.
+const eventBuffer = 16
+
+// Session is the result of Connect.
+type Session struct {
+	// Peers are the peers of the domain ordered by their index, so all peers agree on the order of the domain.
+	Peers []Peer
+	// Index is the position of this client in its domain as assigned by the server, starting at 1. It is zero for
+	// legacy servers.
+	Index int
+	// Role is the role this client registered with, see client.Role.
+	Role Role
+	// Socket is the UDPConn used for connection. You MUST use it for further communication. It is the same as
+	// client.Socket.
+	Socket *net.UDPConn
+	// Reflexive is the public endpoint of this client as observed by the server in its latest response, i.e. the
+	// endpoint the peers will talk to. It is nil if the server did not respond or is a legacy server.
+	Reflexive *net.UDPAddr
+	// KeepAlivePeriod is the period in which keep alive packets should be sent to the peers to keep the NAT mappings
+	// intact. It is derived from the parameters advertised by the server.
+	KeepAlivePeriod time.Duration
+	// Events delivers the changes of the domain pushed by the server after Connect has returned. Events are only
+	// received while reading through ReadFromUDP. If the application does not consume them in time, further events
+	// are dropped. Events is nil unless client.KeepRegistered is set and is closed by Close.
+	Events <-chan Event
+
+	server *net.UDPAddr
+	// relay is the address the messages of the server are relayed from if Connect has fallen back to WebSocket.
+	relay *net.UDPAddr
+	watch *watch
+}
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventPeerLeft signals that the peer left the domain or has been evicted by the server after missing heartbeats.
+	// It should no longer be sent to. Peers which are done after a successful Connect without KeepRegistered are
+	// still connected and not reported.
+	EventPeerLeft EventType = iota + 1
+)
+
+// Event is a change of the domain pushed by the server.
+type Event struct {
+	Type EventType
+	// Peer is the peer affected by the event.
+	Peer Peer
+}
+
+// IsLeader reports whether this client leads its domain, i.e. is the host of a star domain or has the lowest index
+// of all peers of a mesh domain. It is false if the server did not assign indices.
+func (s Session) IsLeader() bool {
+	if s.Role != RoleNone {
+		return s.Role == RoleHost
+	}
+	if s.Index == 0 {
+		return false
+	}
+
+	for _, p := range s.Peers {
+		if p.Index < s.Index {
+			return false
+		}
+	}
+	return true
+}
+
+// Initiates reports whether this client initiates the connection to p, i.e. its index is lower than the one of p.
+// If the server did not assign indices, both peers initiate.
+func (s Session) Initiates(p Peer) bool {
+	if s.Index == 0 || p.Index == 0 {
+		return true
+	}
+
+	return s.Index < p.Index
+}
+
+// ReadFromUDP reads the next packet of a peer from Socket like net.UDPConn.ReadFromUDP. Keep alive packets and
+// packets of the server are consumed and do not return. Changes of the domain pushed by the server are delivered on
+// Events and signals of other peers on client.Signals.
+func (s Session) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := s.Socket.ReadFromUDP(b)
+		if err != nil {
+			return n, addr, err
+		}
+		if n == 0 || protocol.IsKeepAlive(b[:n]) {
+			continue
+		}
+		if s.server == nil || !isServer(addr, s.server, s.relay) {
+			return n, addr, nil
+		}
+
+		if s.watch != nil {
+			s.watch.handle(b[:n])
+		}
+	}
+}
+
+// Close leaves the domain at the server, stops sending heartbeats and closes Events. It does not close Socket. Close
+// does nothing unless client.KeepRegistered is set.
+func (s Session) Close() error {
+	if s.watch == nil {
+		return nil
+	}
+
+	return s.watch.close()
+}
+
+// watch keeps a client registered with domain id after Connect and turns the pushes of the server into events.
+type watch struct {
+	client         client
+	id             []byte
+	stopHeartbeats chan struct{}
+
+	mutex  sync.Mutex
+	closed bool
+	events chan Event
+}
+
+func newWatch(c client, id []byte, stopHeartbeats chan struct{}) *watch {
+	return &watch{
+		client:         c,
+		id:             id,
+		stopHeartbeats: stopHeartbeats,
+		events:         make(chan Event, eventBuffer),
+	}
+}
+
+// handle processes a message of the server.
+func (w *watch) handle(content []byte) {
+	msg, err := w.client.parse(content)
+	if err == nil && msg.Type == protocol.TypeSignal {
+		w.client.deliver(msg)
+	}
+	if err != nil || msg.Type != protocol.TypePeerLeft {
+		return
+	}
+
+	for _, peer := range msg.Peers {
+		w.emit(Event{Type: EventPeerLeft, Peer: peer})
+	}
+}
+
+func (w *watch) emit(e Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- e:
+	default: // the application does not keep up
+	}
+}
+
+func (w *watch) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.stopHeartbeats)
+	close(w.events)
+
+	err := w.client.Leave(w.id)
+	w.client.link.close()
+	return err
+}
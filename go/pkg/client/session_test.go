@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/server"
+)
+
+func TestSession_Events_PeerDone(t *testing.T) {
+	s, err := server.New(freeAddr(t), server.WithHeartbeats(100*time.Millisecond, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.ListenAndServe()
+
+	clients := make([]client, 3)
+	for i := range clients {
+		if clients[i], err = New(s.ListeningAddr); err != nil {
+			t.Fatal(err)
+		}
+		clients[i].Timeout = 5 * time.Second
+		clients[i].HeartbeatPeriod = 100 * time.Millisecond
+	}
+	clients[0].KeepRegistered = true
+
+	sessions := make([]Session, 2)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session, err := clients[i].Connect([]byte("done"), 1)
+			if err != nil {
+				t.Error(err)
+			}
+			sessions[i] = session
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	defer sessions[0].Close()
+	if len(sessions[0].Peers) != 1 {
+		t.Errorf("got %v\n want the peer which is done", sessions[0].Peers)
+	}
+
+	// outlasts the eviction of members which stopped sending heartbeats
+	sessions[0].Socket.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	for {
+		if _, _, err := sessions[0].ReadFromUDP(buf); err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	select {
+	case e := <-sessions[0].Events:
+		t.Errorf("got event %v for peer %v\n want none for a peer which is done", e.Type, e.Peer.Addr)
+	default:
+	}
+
+	info, _, err := clients[2].Query([]byte("done"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Members != 1 {
+		t.Errorf("got %d\n want %d members after the peer is done", info.Members, 1)
+	}
+}
+
+func TestSession_Roles(t *testing.T) {
+	peer := func(index int, role Role) Peer {
+		return Peer{ID: UUID{byte(index)}, Index: index, Role: role}
+	}
+
+	tt := []struct {
+		name          string
+		session       Session
+		other         Peer
+		wantLeader    bool
+		wantInitiates bool
+	}{
+		{name: "first index leads mesh", session: Session{Index: 1, Peers: []Peer{peer(2, RoleNone), peer(3, RoleNone)}}, other: peer(2, RoleNone), wantLeader: true, wantInitiates: true},
+		{name: "lower index initiates", session: Session{Index: 2, Peers: []Peer{peer(1, RoleNone), peer(3, RoleNone)}}, other: peer(3, RoleNone), wantInitiates: true},
+		{name: "higher index waits", session: Session{Index: 3, Peers: []Peer{peer(1, RoleNone), peer(2, RoleNone)}}, other: peer(1, RoleNone)},
+		// after the member with index 1 left, the lowest remaining index leads
+		{name: "lowest remaining index leads", session: Session{Index: 2, Peers: []Peer{peer(3, RoleNone)}}, other: peer(3, RoleNone), wantLeader: true, wantInitiates: true},
+		{name: "no indices assigned", session: Session{Peers: []Peer{{ID: UUID{1}}}}, other: Peer{ID: UUID{1}}, wantInitiates: true},
+		{name: "host leads star", session: Session{Index: 2, Role: RoleHost, Peers: []Peer{peer(1, RoleGuest), peer(3, RoleGuest)}}, other: peer(1, RoleGuest), wantLeader: true},
+		{name: "guest with lowest index does not lead star", session: Session{Index: 1, Role: RoleGuest, Peers: []Peer{peer(2, RoleHost)}}, other: peer(2, RoleHost), wantInitiates: true},
+	}
+
+	for _, tc := range tt {
+		if got := tc.session.IsLeader(); got != tc.wantLeader {
+			t.Errorf("%s: got leader %v\n want %v", tc.name, got, tc.wantLeader)
+		}
+		if got := tc.session.Initiates(tc.other); got != tc.wantInitiates {
+			t.Errorf("%s: got initiates %v\n want %v", tc.name, got, tc.wantInitiates)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+// signalBuffer is the capacity of the channel returned by client.Signals.
+const signalBuffer = 16
+
+// Signal is a message relayed by the server from another member of the domain, e.g. to exchange candidates, offers
+// and answers before a direct path exists.
+type Signal struct {
+	// Domain is the domain id the signal was sent in.
+	Domain []byte
+	// From is the ID of the sending peer.
+	From UUID
+	// Payload is the content of the signal.
+	Payload []byte
+}
+
+// Signal sends payload to the peer with ID to in domain id through the server. If to is zero, payload is sent to all
+// other peers of the domain, or only to the host if this client is a guest. The client must be registered with the
+// domain, i.e. Signal may be called while Connect is still waiting for peers. The size of payload is limited by the
+// server (512 bytes by default).
+//
+// Signals are best-effort: the server drops signals exceeding its limits and signals to unknown peers without
+// notice. Legacy servers do not support signals and ErrLegacyUnsupported is returned.
+func (c client) Signal(id []byte, to UUID, payload []byte) error {
+	if c.Legacy {
+		return ErrLegacyUnsupported
+	}
+
+	signal, err := protocol.Marshal(protocol.Message{
+		Type:     protocol.TypeSignal,
+		Domain:   id,
+		ClientID: c.ID,
+		APIKey:   c.APIKey,
+		Target:   to,
+		Payload:  payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.sendToServer(signal)
+}
+
+// Signals returns the channel delivering the signals of other peers. Signals are received while Connect is running
+// and afterwards while reading through Session.ReadFromUDP. If the application does not consume them in time,
+// further signals are dropped.
+func (c client) Signals() <-chan Signal {
+	return c.signals
+}
+
+// deliver passes the signal msg to the application.
+func (c client) deliver(msg protocol.Message) {
+	select {
+	case c.signals <- Signal{Domain: msg.Domain, From: msg.ClientID, Payload: msg.Payload}:
+	default: // the application does not keep up
+	}
+}
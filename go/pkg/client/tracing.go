@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/4kills/hole-punching/go/pkg/client"
+
+// attribute keys of the spans of the client
+const (
+	attrDomain    = attribute.Key("holepunch.domain")
+	attrPeer      = attribute.Key("holepunch.peer")
+	attrPeers     = attribute.Key("holepunch.peers")
+	attrIndex     = attribute.Key("holepunch.index")
+	attrLeft      = attribute.Key("holepunch.left")
+	attrAttempts  = attribute.Key("holepunch.attempts")
+	attrOutcome   = attribute.Key("holepunch.outcome")
+	attrTransport = attribute.Key("holepunch.transport")
+	attrInitiator = attribute.Key("holepunch.initiator")
+)
+
+// outcomes of spans
+const (
+	outcomeOK       = "ok"
+	outcomeError    = "error"
+	outcomeLeft     = "left"
+	outcomeCanceled = "canceled"
+)
+
+// tracer returns the tracer of client.TracerProvider or of the global provider if it is nil.
+func (c client) tracer() trace.Tracer {
+	tp := c.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// traceParent returns the W3C traceparent of the span of ctx or an empty string if ctx has no span.
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// endSpan records the outcome err of span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attrOutcome.String(outcomeError))
+	} else {
+		span.SetAttributes(attrOutcome.String(outcomeOK))
+	}
+	span.End()
+}
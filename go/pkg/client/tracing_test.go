@@ -0,0 +1,92 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/server"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestClient_ConnectTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	s, err := server.New(freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TracerProvider = tp
+	go s.ListenAndServe()
+
+	clients := make([]client, 2)
+	for i := range clients {
+		if clients[i], err = New(s.ListeningAddr); err != nil {
+			t.Fatal(err)
+		}
+		clients[i].Timeout = 5 * time.Second
+		clients[i].TracerProvider = tp
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c client) {
+			defer wg.Done()
+			if _, err := c.Connect([]byte("traced"), 1); err != nil {
+				t.Error(err)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	spans := recorder.Ended()
+	connects := make(map[string]bool)
+	for _, span := range spans {
+		if span.Name() == "client.Connect" {
+			connects[span.SpanContext().TraceID().String()] = true
+		}
+	}
+	if len(connects) != 2 {
+		t.Fatalf("got %d\n want %d traces of client.Connect", len(connects), 2)
+	}
+
+	got := make(map[string]int)
+	for _, span := range spans {
+		if !connects[span.SpanContext().TraceID().String()] {
+			t.Errorf("got span %s outside of the traces of client.Connect", span.Name())
+		}
+		got[span.Name()]++
+		if span.Name() == "client.connectIndividual" && !hasAttribute(span.Attributes(), attrOutcome.String(outcomeOK)) {
+			t.Errorf("got %v\n want outcome %s", span.Attributes(), outcomeOK)
+		}
+	}
+	for _, name := range []string{"client.connectToServer", "client.ConnectPeers", "client.connectIndividual", "server.handleConnection"} {
+		if got[name] < 2 {
+			t.Errorf("got %d\n want at least %d spans %s", got[name], 2, name)
+		}
+	}
+}
+
+// freeAddr returns a local address with a port which is currently not in use.
+func freeAddr(t *testing.T) string {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, a := range attrs {
+		if a == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"github.com/gorilla/websocket"
+	"net"
+	"sync"
+)
+
+// errUDPUnresponsive is returned by connectToServer if the server did not answer any registration sent over UDP
+// within client.WebSocketFallback.
+var errUDPUnresponsive = errors.New("server did not answer over udp")
+
+// serverLink is the WebSocket connection to the server used if UDP registration is blocked. It is safe for concurrent
+// use.
+//
+// The messages the server sends over WebSocket are relayed to client.Socket from a loopback socket, so they are read
+// alongside the packets of the peers like the messages the server sends over UDP.
+type serverLink struct {
+	mutex sync.Mutex
+	conn  *websocket.Conn
+	relay *net.UDPConn
+}
+
+// open dials url and relays the messages of the server to socket until the link is closed. The server answers
+// registrations with a probe, which is sent back to server over UDP, so the server learns the public endpoint of
+// socket. The challenge the server answers the probe with arrives at socket and is returned by
+// client.returnChallenge.
+func (l *serverLink) open(ctx context.Context, url string, socket *net.UDPConn, server *net.UDPAddr) error {
+	l.close()
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	relay, err := net.ListenUDP(network, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	l.mutex.Lock()
+	l.conn = conn
+	l.relay = relay
+	l.mutex.Unlock()
+
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: socket.LocalAddr().(*net.UDPAddr).Port}
+	go func() {
+		for {
+			_, content, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			msg, err := protocol.Unmarshal(content)
+			if err == nil && msg.Type == protocol.TypeProbe {
+				probe, err := protocol.Marshal(protocol.Message{Type: protocol.TypeProbe, Payload: msg.Payload})
+				if err == nil {
+					socket.WriteToUDP(probe, server)
+				}
+				continue
+			}
+			relay.WriteToUDP(content, local)
+		}
+	}()
+
+	return nil
+}
+
+// send writes payload to the server. It returns false if the link is not open.
+func (l *serverLink) send(payload []byte) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conn == nil {
+		return false, nil
+	}
+	return true, l.conn.WriteMessage(websocket.BinaryMessage, payload)
+}
+
+// relayAddr returns the address the messages of the server are relayed from, or nil if the link is not open.
+func (l *serverLink) relayAddr() *net.UDPAddr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.relay == nil {
+		return nil
+	}
+	return l.relay.LocalAddr().(*net.UDPAddr)
+}
+
+func (l *serverLink) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.conn == nil {
+		return
+	}
+	l.conn.Close()
+	l.relay.Close()
+	l.conn = nil
+	l.relay = nil
+}
+
+// sendToServer sends payload to the server, over WebSocket if client.Connect has fallen back to it.
+func (c client) sendToServer(payload []byte) error {
+	if ok, err := c.link.send(payload); ok {
+		return err
+	}
+
+	_, err := c.Socket.WriteToUDP(payload, c.wellKnownHost)
+	return err
+}
+
+// returnChallenge sends the challenge of the probe msg, which the server sent over UDP, back over WebSocket, so the
+// server binds the WebSocket to the UDP endpoint of the client. Challenges are ignored if the link is not open.
+func (c client) returnChallenge(msg protocol.Message) error {
+	payload, err := protocol.Marshal(protocol.Message{Type: protocol.TypeProbe, Payload: msg.Payload})
+	if err != nil {
+		return err
+	}
+
+	_, err = c.link.send(payload)
+	return err
+}
+
+// isServer reports whether a packet from addr has been sent by the server.
+func (c client) isServer(addr *net.UDPAddr) bool {
+	return isServer(addr, c.wellKnownHost, c.link.relayAddr())
+}
+
+func isServer(addr, server, relay *net.UDPAddr) bool {
+	if addr.String() == server.String() {
+		return true
+	}
+	return relay != nil && addr.String() == relay.String()
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/server"
+)
+
+func TestClient_Connect_WebSocket(t *testing.T) {
+	s, err := server.New(freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.ListenAndServe()
+	ts := httptest.NewServer(s.WebSocketHandler())
+	defer ts.Close()
+
+	clients := make([]client, 2)
+	for i := range clients {
+		if clients[i], err = New(s.ListeningAddr); err != nil {
+			t.Fatal(err)
+		}
+		clients[i].Timeout = 5 * time.Second
+	}
+	// falls back to WebSocket before the server can answer over UDP
+	clients[0].WebSocketURL = "ws" + strings.TrimPrefix(ts.URL, "http") + server.WebSocketPath
+	clients[0].WebSocketFallback = time.Nanosecond
+
+	sessions := make([]Session, len(clients))
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session, err := clients[i].Connect([]byte("relayed"), 1)
+			if err != nil {
+				t.Error(err)
+			}
+			sessions[i] = session
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	if sessions[0].relay == nil {
+		t.Errorf("got no relay\n want connect over WebSocket")
+	}
+	for i, session := range sessions {
+		other := sessions[1-i]
+		if len(session.Peers) != 1 || session.Peers[0].Addr.Port != other.Socket.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("got %v\n want the UDP endpoint of the other client", session.Peers)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// address families of encoded endpoints
+const (
+	familyIPv4 byte = 4
+	familyIPv6 byte = 6
+)
+
+// appendEndpoint appends the typed encoding of addr to b:
+//
+//	endpoint := family(4|6) ip(4|16 bytes) port(uint16, big endian)
+//
+// IPv4-mapped IPv6 addresses are encoded as IPv4. Zones are not encoded.
+func appendEndpoint(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, familyIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, familyIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+
+	return appendUint16(b, uint16(addr.Port))
+}
+
+func decodeEndpoint(b []byte) (*net.UDPAddr, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty endpoint", ErrMalformed)
+	}
+
+	var ipLen int
+	switch b[0] {
+	case familyIPv4:
+		ipLen = net.IPv4len
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", ErrMalformed, b[0])
+	}
+	if len(b) != 1+ipLen+2 {
+		return nil, fmt.Errorf("%w: endpoint of family %d with length %d", ErrMalformed, b[0], len(b))
+	}
+
+	ip := make(net.IP, ipLen)
+	copy(ip, b[1:1+ipLen])
+
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b[1+ipLen:]))}, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
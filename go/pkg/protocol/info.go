@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// domain info field tags, nested in the value of a tagInfo field.
+const (
+	infoTagMembers byte = iota + 1
+	infoTagSize
+	infoTagAge
+	infoTagSealed
+)
+
+// DomainInfo is the state of a domain as answered to a TypeQuery message.
+type DomainInfo struct {
+	// Members is the number of members currently registered with the domain.
+	Members int
+	// Size is the declared size of the domain. Zero means no size has been declared.
+	Size int
+	// Age is the time since the domain was created. It is zero for domains without members.
+	Age time.Duration
+	// Sealed reports whether the domain is complete and does not admit new members.
+	Sealed bool
+}
+
+func (d DomainInfo) marshal() []byte {
+	var w writer
+	if d.Members > 0 {
+		w.field(infoTagMembers, appendUint32(nil, uint32(d.Members)))
+	}
+	if d.Size > 0 {
+		w.uint16Field(infoTagSize, d.Size)
+	}
+	w.durationField(infoTagAge, d.Age)
+	if d.Sealed {
+		w.field(infoTagSealed, []byte{1})
+	}
+
+	return w.buf
+}
+
+func (d *DomainInfo) unmarshal(b []byte) error {
+	return readFields(b, func(tag byte, value []byte) error {
+		switch tag {
+		case infoTagMembers, infoTagAge:
+			if len(value) != 4 {
+				return fmt.Errorf("%w: field %d of length %d, want 4", ErrMalformed, tag, len(value))
+			}
+			v := binary.BigEndian.Uint32(value)
+			if tag == infoTagMembers {
+				d.Members = int(v)
+			} else {
+				d.Age = time.Duration(v) * time.Millisecond
+			}
+		case infoTagSize:
+			v, err := readUint16(tag, value)
+			d.Size = int(v)
+			return err
+		case infoTagSealed:
+			d.Sealed = len(value) == 1 && value[0] != 0
+		}
+		return nil
+	})
+}
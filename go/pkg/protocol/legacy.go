@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"net"
+	"strings"
+)
+
+// The legacy text protocol predates framing: clients send the raw domain id and the server answers with the
+// comma-joined endpoints of the other members. Keep alive packets are empty datagrams.
+
+const legacySeparator = ","
+
+// EncodeLegacyPeers encodes peers as a legacy text peer list. Peer IDs cannot be represented and are dropped.
+func EncodeLegacyPeers(peers []Peer) []byte {
+	s := make([]string, len(peers))
+	for i, p := range peers {
+		s[i] = p.Addr.String()
+	}
+
+	return []byte(strings.Join(s, legacySeparator))
+}
+
+// DecodeLegacyPeers decodes a legacy text peer list. An empty content yields no peers. The returned peers have no ID.
+func DecodeLegacyPeers(content []byte) ([]Peer, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	rawAddrs := strings.Split(string(content), legacySeparator)
+	ret := make([]Peer, len(rawAddrs))
+
+	for i, v := range rawAddrs {
+		addr, err := net.ResolveUDPAddr("udp", v)
+		if err != nil {
+			return ret, err
+		}
+		ret[i] = Peer{Addr: addr}
+	}
+
+	return ret, nil
+}
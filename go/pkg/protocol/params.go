@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// params field tags, nested in the value of a tagParams field.
+const (
+	paramsTagKeepAlive byte = iota + 1
+	paramsTagHeartbeat
+	paramsTagMemberTTL
+	paramsTagMaxPacketSize
+	paramsTagRetryPeriod
+)
+
+// Params are the session parameters the server advertises in its responses to registrations, so that clients can
+// adapt to its configuration. Zero fields are unknown or disabled.
+type Params struct {
+	// KeepAliveInterval is the interval in which the server sends keep alive packets to registered members.
+	KeepAliveInterval time.Duration
+	// HeartbeatInterval is the interval in which the server expects registered members to send heartbeats.
+	HeartbeatInterval time.Duration
+	// MemberTTL is the time after which a member which has not been heard of is evicted from its domain.
+	MemberTTL time.Duration
+	// MaxPacketSize is the maximum size of a datagram accepted by the server. Registrations, including their domain
+	// id and token, must fit into it.
+	MaxPacketSize int
+	// RetryPeriod is the minimum delay between registration attempts which keeps a client below the rate limit of
+	// the server.
+	RetryPeriod time.Duration
+}
+
+// Durations are encoded as uint32 milliseconds, which suffices for about 49 days.
+
+func (p Params) marshal() []byte {
+	var w writer
+	w.durationField(paramsTagKeepAlive, p.KeepAliveInterval)
+	w.durationField(paramsTagHeartbeat, p.HeartbeatInterval)
+	w.durationField(paramsTagMemberTTL, p.MemberTTL)
+	if p.MaxPacketSize > 0 {
+		w.field(paramsTagMaxPacketSize, appendUint32(nil, uint32(p.MaxPacketSize)))
+	}
+	w.durationField(paramsTagRetryPeriod, p.RetryPeriod)
+
+	return w.buf
+}
+
+func (p *Params) unmarshal(b []byte) error {
+	return readFields(b, func(tag byte, value []byte) error {
+		var v uint32
+		switch tag {
+		case paramsTagKeepAlive, paramsTagHeartbeat, paramsTagMemberTTL, paramsTagMaxPacketSize, paramsTagRetryPeriod:
+			if len(value) != 4 {
+				return fmt.Errorf("%w: parameter %d of length %d, want 4", ErrMalformed, tag, len(value))
+			}
+			v = binary.BigEndian.Uint32(value)
+		default:
+			return nil
+		}
+
+		d := time.Duration(v) * time.Millisecond
+		switch tag {
+		case paramsTagKeepAlive:
+			p.KeepAliveInterval = d
+		case paramsTagHeartbeat:
+			p.HeartbeatInterval = d
+		case paramsTagMemberTTL:
+			p.MemberTTL = d
+		case paramsTagMaxPacketSize:
+			p.MaxPacketSize = int(v)
+		case paramsTagRetryPeriod:
+			p.RetryPeriod = d
+		}
+		return nil
+	})
+}
+
+// durationField writes the positive duration d in milliseconds, saturating at the maximum of uint32.
+func (w *writer) durationField(tag byte, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	ms := d / time.Millisecond
+	if ms > 0xffffffff {
+		ms = 0xffffffff
+	}
+	w.field(tag, appendUint32(nil, uint32(ms)))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,609 @@
+// Package protocol implements the framed, versioned wire format spoken between the hole punching clients and the
+// rendezvous server.
+//
+// Every framed datagram starts with a fixed three byte header followed by any number of fields:
+//
+//	frame  := magic(0xFE) version(1 byte) type(1 byte) field*
+//	field  := tag(1 byte) length(uint16, big endian) value(length bytes)
+//
+// The magic byte 0xFE never occurs in UTF-8 encoded text, which allows servers to tell framed messages apart from the
+// legacy text protocol (see DecodeLegacyPeers). Decoders skip fields with unknown tags so new fields can be added
+// without breaking older peers. Incompatible changes must bump Version.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// Magic is the first byte of every framed message.
+	Magic byte = 0xFE
+	// Version is the protocol version written by this package. Messages of other versions are rejected.
+	Version byte = 1
+
+	headerLen      = 3
+	fieldHeaderLen = 3
+	maxFieldLen    = 0xffff
+)
+
+var (
+	// ErrMalformed is returned if a datagram cannot be decoded as a framed message.
+	ErrMalformed = errors.New("malformed message")
+	// ErrUnsupportedVersion is returned if a framed message carries a version this package does not speak.
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Type identifies the purpose of a message.
+type Type byte
+
+const (
+	// TypeRegister is sent by clients to register their endpoint with a domain.
+	TypeRegister Type = iota + 1
+	// TypePeers is sent by the server and carries the endpoints of the other members of a domain.
+	TypePeers
+	// TypeKeepAlive is sent to keep NAT mappings intact. It carries no fields and must be ignored by the receiver.
+	TypeKeepAlive
+	// TypeError is sent by the server if it rejects a message.
+	TypeError
+	// TypePeerJoined is pushed by the server to the existing members of a domain and carries the endpoint of a newly
+	// registered member.
+	TypePeerJoined
+	// TypeLeave is sent by clients to deregister from a domain.
+	TypeLeave
+	// TypeReady is sent by the server to every member once a domain has reached its declared size. It carries the
+	// final list of the other members. The domain is sealed from then on.
+	TypeReady
+	// TypeHeartbeat is sent periodically by registered clients to signal they are still present in a domain.
+	TypeHeartbeat
+	// TypePeerLeft is pushed by the server to the remaining members of a domain and carries the members which left
+	// or have been evicted.
+	TypePeerLeft
+	// TypeQuery is sent by clients to learn about the state of a domain without joining it.
+	TypeQuery
+	// TypeDomainInfo is the answer of the server to a TypeQuery message. It carries the state of the domain and, if
+	// the query carried a token authorizing the domain, its members.
+	TypeDomainInfo
+	// TypeSignal carries a payload from one member of a domain to another or to all other members. Clients send it
+	// to the server, which relays it to the targets.
+	TypeSignal
+	// TypeProbe lets the server learn the UDP endpoint of a client registering over WebSocket. The server answers
+	// the registration with a TypeProbe message carrying a nonce as Payload, which the client sends back over UDP.
+	// The server answers that probe with a TypeProbe message carrying a challenge, sent to the UDP endpoint of the
+	// probe, which the client returns over WebSocket to prove that it owns the endpoint.
+	TypeProbe
+	// TypeDone is sent by clients which have connected to their peers and no longer need the server. Like TypeLeave,
+	// it deregisters the client from its domain, but the remaining members are not told that it left.
+	TypeDone
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeRegister:
+		return "register"
+	case TypePeers:
+		return "peers"
+	case TypeKeepAlive:
+		return "keep-alive"
+	case TypeError:
+		return "error"
+	case TypePeerJoined:
+		return "peer joined"
+	case TypeLeave:
+		return "leave"
+	case TypeReady:
+		return "ready"
+	case TypeHeartbeat:
+		return "heartbeat"
+	case TypePeerLeft:
+		return "peer left"
+	case TypeQuery:
+		return "query"
+	case TypeDomainInfo:
+		return "domain info"
+	case TypeSignal:
+		return "signal"
+	case TypeProbe:
+		return "probe"
+	case TypeDone:
+		return "done"
+	default:
+		return fmt.Sprintf("type(%d)", byte(t))
+	}
+}
+
+// ErrorCode is the machine-readable reason carried by a TypeError message.
+type ErrorCode uint16
+
+const (
+	// CodeUnknown is used if the server does not state a reason.
+	CodeUnknown ErrorCode = iota
+	// CodeMalformed means the server could not decode the message.
+	CodeMalformed
+	// CodeUnsupportedVersion means the server does not speak the protocol version of the message.
+	CodeUnsupportedVersion
+	// CodeUnauthorized means the registration lacks a valid join token for its domain.
+	CodeUnauthorized
+	// CodeDomainFull means the domain has reached its maximum number of members.
+	CodeDomainFull
+	// CodeDomainSealed means the domain is complete and does not admit new members.
+	CodeDomainSealed
+	// CodeSizeMismatch means the declared size differs from the size of the domain.
+	CodeSizeMismatch
+	// CodePacketTooLarge means the datagram exceeded the maximum packet size of the server, e.g. due to a long
+	// domain id.
+	CodePacketTooLarge
+	// CodeStoreFailure means the server could not store the registration.
+	CodeStoreFailure
+	// CodeRateLimited means the sender exceeded the number of packets the server accepts per second.
+	CodeRateLimited
+	// CodeNotRegistered means the sender of a heartbeat is not a member of the domain, e.g. because it has been
+	// evicted. It should register again.
+	CodeNotRegistered
+	// CodeRoleConflict means the role of the registration does not fit the domain, e.g. a second host or a member
+	// without role registering with a star domain.
+	CodeRoleConflict
+	// CodeMetadataTooLarge means the metadata of the registration exceeds the maximum metadata size of the server.
+	CodeMetadataTooLarge
+	// CodeQuotaExceeded means the tenant of the message has reached a quota of the server, e.g. its maximum number
+	// of domains.
+	CodeQuotaExceeded
+	// CodeNotProvisioned means the server only admits registrations with domains provisioned by the backend and the
+	// domain has not been provisioned or its provision has expired.
+	CodeNotProvisioned
+	// CodeIDInUse means another endpoint is registered with the client ID of the registration and the registration
+	// neither carries the secret that endpoint registered with nor a join token bound to the client ID, either of
+	// which would allow it to replace that endpoint.
+	CodeIDInUse
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "unknown"
+	case CodeMalformed:
+		return "malformed message"
+	case CodeUnsupportedVersion:
+		return "unsupported version"
+	case CodeUnauthorized:
+		return "unauthorized"
+	case CodeDomainFull:
+		return "domain full"
+	case CodeDomainSealed:
+		return "domain sealed"
+	case CodeSizeMismatch:
+		return "size mismatch"
+	case CodePacketTooLarge:
+		return "packet too large"
+	case CodeStoreFailure:
+		return "store failure"
+	case CodeRateLimited:
+		return "rate limited"
+	case CodeNotRegistered:
+		return "not registered"
+	case CodeRoleConflict:
+		return "role conflict"
+	case CodeMetadataTooLarge:
+		return "metadata too large"
+	case CodeQuotaExceeded:
+		return "quota exceeded"
+	case CodeNotProvisioned:
+		return "not provisioned"
+	case CodeIDInUse:
+		return "id in use"
+	default:
+		return fmt.Sprintf("code(%d)", uint16(c))
+	}
+}
+
+// field tags. Tags must never be reused for a different meaning.
+const (
+	tagDomain byte = iota + 1
+	tagPeer
+	tagCode
+	tagReason
+	tagClientID
+	tagToken
+	tagSize
+	tagReflexive
+	tagParams
+	tagIndex
+	tagRole
+	tagInfo
+	tagMetadata
+	tagTarget
+	tagPayload
+	tagAPIKey
+	tagTraceParent
+	tagSecret
+)
+
+// peer field tags, nested in the value of a tagPeer field.
+const (
+	peerTagID byte = iota + 1
+	peerTagEndpoint
+	peerTagIndex
+	peerTagRole
+	peerTagMetadata
+)
+
+// Message is the decoded form of a framed datagram. Which fields are set depends on Type; zero fields are not encoded.
+type Message struct {
+	Type Type
+
+	// Domain is the domain id a TypeRegister message registers with, a TypeLeave message deregisters from, a
+	// TypeHeartbeat message signals presence in or a TypeQuery or TypeDomainInfo message is about.
+	Domain []byte
+	// ClientID is the persistent identity of the client sending a TypeRegister, TypeLeave, TypeHeartbeat or
+	// TypeSignal message. On relayed TypeSignal messages it is the identity of the original sender.
+	ClientID UUID
+	// Target is the identity of the member a TypeSignal message is relayed to. Zero means all other members.
+	Target UUID
+	// Payload is the opaque content of a TypeSignal message or the nonce of a TypeProbe message.
+	Payload []byte
+	// Token is the join token authorizing a TypeRegister or TypeQuery message.
+	Token string
+	// Secret proves that the sender of a TypeRegister message owns ClientID. The server keeps a hash of the secret
+	// a client ID first registered with and only lets a registration from another endpoint replace that member if it
+	// carries the same secret.
+	Secret []byte
+	// APIKey identifies the tenant a message referring to a domain is sent on behalf of. Domains of different
+	// tenants are separate even if their ids are equal.
+	APIKey string
+	// TraceParent is the W3C traceparent of the span a TypeRegister message is sent in, so the server continues the
+	// trace of the client.
+	TraceParent string
+	// Role is the role a TypeRegister message registers with.
+	Role Role
+	// Metadata is the opaque blob a TypeRegister message attaches to the member, e.g. a display name or public key.
+	Metadata []byte
+	// Size is the number of members, including the sender, a TypeRegister message expects its domain to have.
+	// Zero means no size is declared.
+	Size int
+	// Peers are the members carried by a TypePeers, TypePeerJoined, TypePeerLeft or TypeReady message, ordered by
+	// their index.
+	Peers []Peer
+	// Index is the index of the receiver of a TypePeers or TypeReady message in its domain.
+	Index int
+
+	// Reflexive is the endpoint of the receiver as observed by the server. The server sets it on all its replies.
+	Reflexive *net.UDPAddr
+
+	// Info is the state of the domain carried by a TypeDomainInfo message.
+	Info *DomainInfo
+
+	// Params are the session parameters of the server. The server sets them on its replies to TypeRegister
+	// messages, i.e. on TypePeers and TypeError messages.
+	Params *Params
+
+	// Code and Reason describe why the server rejected a message. They are only used by TypeError messages.
+	Code   ErrorCode
+	Reason string
+}
+
+// Peer is a member of a domain.
+type Peer struct {
+	// ID is the persistent identity of the peer. It is zero for peers which registered without identity.
+	ID UUID
+	// Addr is the endpoint of the peer as seen by the server.
+	Addr *net.UDPAddr
+	// Index is the position of the peer in its domain, starting at 1. It is assigned by the server and stays the same
+	// while the peer is a member. Of each pair of peers, the one with the lower index initiates the connection and
+	// the one with the lowest index leads the domain. It is zero if the server does not assign indices.
+	Index int
+	// Role is the role the peer registered with.
+	Role Role
+	// Metadata is the opaque blob the peer attached to its registration. It is nil if the peer attached none.
+	Metadata []byte
+}
+
+// Role is the role of a member in a star domain. Domains whose members register without a role are full meshes.
+type Role byte
+
+const (
+	// RoleNone is the role of members of mesh domains, in which every member connects to every other member.
+	RoleNone Role = iota
+	// RoleHost is the single member of a star domain all guests connect to. It learns about all guests.
+	RoleHost
+	// RoleGuest is a member of a star domain which only learns about and connects to the host.
+	RoleGuest
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleNone:
+		return "none"
+	case RoleHost:
+		return "host"
+	case RoleGuest:
+		return "guest"
+	default:
+		return fmt.Sprintf("role(%d)", byte(r))
+	}
+}
+
+// Sees reports whether a member with role r learns about and connects to a member with role o. Guests only see the
+// host, all other members see everyone.
+func (r Role) Sees(o Role) bool {
+	return r != RoleGuest || o == RoleHost
+}
+
+// IsFramed reports whether b starts like a framed message. It does not validate the rest of b.
+func IsFramed(b []byte) bool {
+	return len(b) >= headerLen && b[0] == Magic
+}
+
+// IsKeepAlive reports whether b is a framed keep alive message.
+func IsKeepAlive(b []byte) bool {
+	return IsFramed(b) && b[1] == Version && Type(b[2]) == TypeKeepAlive
+}
+
+// MarshalBinary encodes m as a framed datagram.
+func (m Message) MarshalBinary() ([]byte, error) {
+	w := writer{buf: []byte{Magic, Version, byte(m.Type)}}
+
+	if len(m.Domain) > 0 {
+		w.field(tagDomain, m.Domain)
+	}
+	if !m.ClientID.IsZero() {
+		w.field(tagClientID, m.ClientID[:])
+	}
+	if m.Token != "" {
+		w.field(tagToken, []byte(m.Token))
+	}
+	if len(m.Secret) > 0 {
+		w.field(tagSecret, m.Secret)
+	}
+	if m.APIKey != "" {
+		w.field(tagAPIKey, []byte(m.APIKey))
+	}
+	if m.TraceParent != "" {
+		w.field(tagTraceParent, []byte(m.TraceParent))
+	}
+	if !m.Target.IsZero() {
+		w.field(tagTarget, m.Target[:])
+	}
+	if len(m.Payload) > 0 {
+		w.field(tagPayload, m.Payload)
+	}
+	if m.Role != RoleNone {
+		w.field(tagRole, []byte{byte(m.Role)})
+	}
+	if len(m.Metadata) > 0 {
+		w.field(tagMetadata, m.Metadata)
+	}
+	if m.Size > 0 {
+		w.uint16Field(tagSize, m.Size)
+	}
+	for _, p := range m.Peers {
+		w.field(tagPeer, p.marshal())
+	}
+	if m.Index > 0 {
+		w.uint16Field(tagIndex, m.Index)
+	}
+	if m.Reflexive != nil {
+		w.field(tagReflexive, appendEndpoint(nil, m.Reflexive))
+	}
+	if m.Info != nil {
+		w.field(tagInfo, m.Info.marshal())
+	}
+	if m.Params != nil {
+		w.field(tagParams, m.Params.marshal())
+	}
+	if m.Code != CodeUnknown {
+		w.uint16Field(tagCode, int(m.Code))
+	}
+	if m.Reason != "" {
+		w.field(tagReason, []byte(m.Reason))
+	}
+
+	return w.buf, w.err
+}
+
+// UnmarshalBinary decodes the framed datagram data into m. The decoded message does not reference data.
+func (m *Message) UnmarshalBinary(data []byte) error {
+	if !IsFramed(data) {
+		return fmt.Errorf("%w: missing header", ErrMalformed)
+	}
+	if data[1] != Version {
+		return fmt.Errorf("%w: got version %d, want %d", ErrUnsupportedVersion, data[1], Version)
+	}
+
+	*m = Message{Type: Type(data[2])}
+
+	return readFields(data[headerLen:], func(tag byte, value []byte) error {
+		switch tag {
+		case tagDomain:
+			m.Domain = append([]byte(nil), value...)
+		case tagClientID:
+			if len(value) != len(m.ClientID) {
+				return fmt.Errorf("%w: client id of length %d", ErrMalformed, len(value))
+			}
+			copy(m.ClientID[:], value)
+		case tagToken:
+			m.Token = string(value)
+		case tagSecret:
+			m.Secret = append([]byte(nil), value...)
+		case tagAPIKey:
+			m.APIKey = string(value)
+		case tagTraceParent:
+			m.TraceParent = string(value)
+		case tagTarget:
+			if len(value) != len(m.Target) {
+				return fmt.Errorf("%w: target of length %d", ErrMalformed, len(value))
+			}
+			copy(m.Target[:], value)
+		case tagPayload:
+			m.Payload = append([]byte(nil), value...)
+		case tagPeer:
+			var p Peer
+			if err := p.unmarshal(value); err != nil {
+				return err
+			}
+			m.Peers = append(m.Peers, p)
+		case tagReflexive:
+			addr, err := decodeEndpoint(value)
+			m.Reflexive = addr
+			return err
+		case tagInfo:
+			m.Info = &DomainInfo{}
+			return m.Info.unmarshal(value)
+		case tagParams:
+			m.Params = &Params{}
+			return m.Params.unmarshal(value)
+		case tagSize:
+			v, err := readUint16(tag, value)
+			m.Size = int(v)
+			return err
+		case tagIndex:
+			v, err := readUint16(tag, value)
+			m.Index = int(v)
+			return err
+		case tagRole:
+			r, err := readRole(tag, value)
+			m.Role = r
+			return err
+		case tagMetadata:
+			m.Metadata = append([]byte(nil), value...)
+		case tagCode:
+			v, err := readUint16(tag, value)
+			m.Code = ErrorCode(v)
+			return err
+		case tagReason:
+			m.Reason = string(value)
+		}
+		// unknown tags are skipped to stay compatible with newer peers
+		return nil
+	})
+}
+
+// Marshal is a convenience wrapper around Message.MarshalBinary.
+func Marshal(m Message) ([]byte, error) {
+	return m.MarshalBinary()
+}
+
+// Unmarshal is a convenience wrapper around Message.UnmarshalBinary.
+func Unmarshal(data []byte) (Message, error) {
+	var m Message
+	err := m.UnmarshalBinary(data)
+	return m, err
+}
+
+func (p Peer) marshal() []byte {
+	var w writer
+	if !p.ID.IsZero() {
+		w.field(peerTagID, p.ID[:])
+	}
+	w.field(peerTagEndpoint, appendEndpoint(nil, p.Addr))
+	if p.Index > 0 {
+		w.uint16Field(peerTagIndex, p.Index)
+	}
+	if p.Role != RoleNone {
+		w.field(peerTagRole, []byte{byte(p.Role)})
+	}
+	if len(p.Metadata) > 0 {
+		w.field(peerTagMetadata, p.Metadata)
+	}
+
+	return w.buf
+}
+
+func (p *Peer) unmarshal(b []byte) error {
+	err := readFields(b, func(tag byte, value []byte) error {
+		switch tag {
+		case peerTagID:
+			if len(value) != len(p.ID) {
+				return fmt.Errorf("%w: peer id of length %d", ErrMalformed, len(value))
+			}
+			copy(p.ID[:], value)
+		case peerTagEndpoint:
+			addr, err := decodeEndpoint(value)
+			if err != nil {
+				return err
+			}
+			p.Addr = addr
+		case peerTagIndex:
+			v, err := readUint16(tag, value)
+			p.Index = int(v)
+			return err
+		case peerTagRole:
+			r, err := readRole(tag, value)
+			p.Role = r
+			return err
+		case peerTagMetadata:
+			p.Metadata = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err == nil && p.Addr == nil {
+		err = fmt.Errorf("%w: peer without endpoint", ErrMalformed)
+	}
+
+	return err
+}
+
+type writer struct {
+	buf []byte
+	err error
+}
+
+func (w *writer) field(tag byte, value []byte) {
+	if w.err != nil {
+		return
+	}
+	if len(value) > maxFieldLen {
+		w.err = fmt.Errorf("field %d exceeds %d bytes", tag, maxFieldLen)
+		return
+	}
+
+	w.buf = append(w.buf, tag)
+	w.buf = appendUint16(w.buf, uint16(len(value)))
+	w.buf = append(w.buf, value...)
+}
+
+func (w *writer) uint16Field(tag byte, v int) {
+	if v > 0xffff {
+		if w.err == nil {
+			w.err = fmt.Errorf("value %d of field %d exceeds %d", v, tag, 0xffff)
+		}
+		return
+	}
+	w.field(tag, appendUint16(nil, uint16(v)))
+}
+
+func readUint16(tag byte, value []byte) (uint16, error) {
+	if len(value) != 2 {
+		return 0, fmt.Errorf("%w: field %d of length %d, want 2", ErrMalformed, tag, len(value))
+	}
+	return binary.BigEndian.Uint16(value), nil
+}
+
+func readRole(tag byte, value []byte) (Role, error) {
+	if len(value) != 1 {
+		return RoleNone, fmt.Errorf("%w: field %d of length %d, want 1", ErrMalformed, tag, len(value))
+	}
+	return Role(value[0]), nil
+}
+
+func readFields(b []byte, fn func(tag byte, value []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < fieldHeaderLen {
+			return fmt.Errorf("%w: truncated field header", ErrMalformed)
+		}
+		tag := b[0]
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[fieldHeaderLen:]
+		if len(b) < n {
+			return fmt.Errorf("%w: field %d truncated: want %d bytes, have %d", ErrMalformed, tag, n, len(b))
+		}
+
+		if err := fn(tag, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessage_RoundTrip(t *testing.T) {
+	tt := []Message{
+		{
+			Type:   TypeRegister,
+			Domain: []byte("myDomain"),
+		},
+		{
+			Type:        TypeRegister,
+			Domain:      []byte("myDomain"),
+			ClientID:    UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8},
+			Token:       "eyJhbGciOiJIUzI1NiJ9.e30.c2lnbmF0dXJl",
+			Secret:      []byte{0x5e, 0xc2, 0xe7},
+			APIKey:      "product-key",
+			TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			Role:        RoleGuest,
+			Metadata:    []byte(`{"name":"alice"}`),
+			Size:        4,
+		},
+		{
+			Type: TypePeers,
+			Peers: []Peer{
+				{Addr: &net.UDPAddr{IP: net.ParseIP("143.92.93.227").To4(), Port: 33333}},
+				{
+					ID:       UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8},
+					Addr:     &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 45433},
+					Index:    2,
+					Role:     RoleHost,
+					Metadata: []byte{0x01, 0x02},
+				},
+			},
+			Index: 3,
+		},
+		{
+			Type:      TypePeers,
+			Reflexive: &net.UDPAddr{IP: net.ParseIP("47.123.241.125").To4(), Port: 45433},
+		},
+		{
+			Type: TypePeers,
+			Params: &Params{
+				KeepAliveInterval: 10 * time.Second,
+				HeartbeatInterval: 10 * time.Second,
+				MemberTTL:         30 * time.Second,
+				MaxPacketSize:     1024,
+				RetryPeriod:       50 * time.Millisecond,
+			},
+		},
+		{
+			Type:   TypeDomainInfo,
+			Domain: []byte("myDomain"),
+			Info:   &DomainInfo{Members: 3, Size: 4, Age: 90 * time.Second, Sealed: true},
+		},
+		{
+			Type:     TypeSignal,
+			Domain:   []byte("myDomain"),
+			ClientID: UUID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8},
+			Target:   UUID{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8},
+			Payload:  []byte("offer"),
+		},
+		{
+			Type: TypeKeepAlive,
+		},
+		{
+			Type:   TypeError,
+			Code:   CodeMalformed,
+			Reason: "truncated field header",
+		},
+	}
+
+	for _, want := range tt {
+		b, err := Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := Unmarshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Type != want.Type || !bytes.Equal(got.Domain, want.Domain) || got.ClientID != want.ClientID || got.Target != want.Target || !bytes.Equal(got.Payload, want.Payload) || got.Token != want.Token || got.APIKey != want.APIKey || got.TraceParent != want.TraceParent || !bytes.Equal(got.Metadata, want.Metadata) || got.Size != want.Size || got.Index != want.Index || got.Role != want.Role ||
+			got.Code != want.Code || got.Reason != want.Reason {
+			t.Errorf("got %+v\n want %+v", got, want)
+		}
+		if (got.Reflexive == nil) != (want.Reflexive == nil) || got.Reflexive != nil && got.Reflexive.String() != want.Reflexive.String() {
+			t.Errorf("got %v\n want %v", got.Reflexive, want.Reflexive)
+		}
+		if (got.Info == nil) != (want.Info == nil) || got.Info != nil && *got.Info != *want.Info {
+			t.Errorf("got %v\n want %v", got.Info, want.Info)
+		}
+		if (got.Params == nil) != (want.Params == nil) || got.Params != nil && *got.Params != *want.Params {
+			t.Errorf("got %v\n want %v", got.Params, want.Params)
+		}
+		if len(got.Peers) != len(want.Peers) {
+			t.Fatalf("got %v\n want %v", got.Peers, want.Peers)
+		}
+		for i := range got.Peers {
+			if got.Peers[i].ID != want.Peers[i].ID || got.Peers[i].Addr.String() != want.Peers[i].Addr.String() || got.Peers[i].Index != want.Peers[i].Index ||
+				got.Peers[i].Role != want.Peers[i].Role || !bytes.Equal(got.Peers[i].Metadata, want.Peers[i].Metadata) {
+				t.Errorf("got %v\n want %v", got.Peers[i], want.Peers[i])
+			}
+		}
+	}
+}
+
+func TestMessage_UnmarshalBinary(t *testing.T) {
+	tt := []struct {
+		data    []byte
+		wantErr error
+	}{
+		{data: []byte("myDomain"), wantErr: ErrMalformed},
+		{data: []byte{Magic, Version + 1, byte(TypeKeepAlive)}, wantErr: ErrUnsupportedVersion},
+		{data: []byte{Magic, Version, byte(TypeRegister), tagDomain, 0}, wantErr: ErrMalformed},
+		{data: []byte{Magic, Version, byte(TypeRegister), tagDomain, 0, 4, 'a'}, wantErr: ErrMalformed},
+		{data: []byte{Magic, Version, byte(TypePeers), tagPeer, 0, 5, peerTagEndpoint, 0, 2, familyIPv4, 1}, wantErr: ErrMalformed},
+		{data: []byte{Magic, Version, byte(TypePeers), tagPeer, 0, 0}, wantErr: ErrMalformed},
+		// unknown fields are skipped
+		{data: []byte{Magic, Version, byte(TypeRegister), 0xff, 0, 1, 'a', tagDomain, 0, 1, 'a'}},
+	}
+
+	for _, tc := range tt {
+		_, err := Unmarshal(tc.data)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("got %v\n want %v", err, tc.wantErr)
+		}
+	}
+}
+
+func TestDecodeLegacyPeers(t *testing.T) {
+	peers, err := DecodeLegacyPeers(nil)
+	if err != nil || len(peers) != 0 {
+		t.Errorf("got %v, %v\n want no peers", peers, err)
+	}
+
+	want := "143.92.93.227:33333,47.123.241.125:45433"
+	peers, err = DecodeLegacyPeers([]byte(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(EncodeLegacyPeers(peers)); got != want {
+		t.Errorf("got %v\n want %v", got, want)
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	want := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	u, err := ParseUUID(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.String(); got != want {
+		t.Errorf("got %v\n want %v", got, want)
+	}
+
+	if _, err := ParseUUID("6ba7b810-9dad-11d1-80b4"); err == nil {
+		t.Errorf("got %v\n want an error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// UUID identifies a client independently of its endpoint, e.g. across restarts which change its port.
+type UUID [16]byte
+
+// NewUUID returns a random (version 4) UUID.
+func NewUUID() (UUID, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return u, err
+	}
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // variant 10
+
+	return u, nil
+}
+
+// ParseUUID parses the canonical textual representation xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx of a UUID.
+func ParseUUID(s string) (UUID, error) {
+	var u UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, fmt.Errorf("invalid UUID %q", s)
+	}
+
+	b, err := hex.DecodeString(s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:])
+	if err != nil {
+		return u, fmt.Errorf("invalid UUID %q: %w", s, err)
+	}
+	copy(u[:], b)
+
+	return u, nil
+}
+
+// IsZero reports whether u is the zero UUID, which is used by clients without identity.
+func (u UUID) IsZero() bool {
+	return u == UUID{}
+}
+
+// String returns the canonical textual representation of u.
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// AdminPath is the path prefix of the admin API.
+	AdminPath = "/admin/domains"
+	// HealthPath answers with 200 OK as long as the process serves HTTP.
+	HealthPath = "/healthz"
+	// ReadyPath answers with 200 OK once server.ListenAndServe handles packets and the server.AddrStore is
+	// reachable, otherwise with 503 Service Unavailable.
+	ReadyPath = "/readyz"
+)
+
+// AdminHandler returns a http.Handler serving the admin API, the health and readiness endpoints and the metrics.
+// Mount it at the root of your own HTTPS server or set server.AdminAddr. Requests to the admin API must carry
+// server.AdminToken as bearer token, the health, readiness and metrics endpoints are public. Domains are identified
+// by their key in the server.AddrStore, i.e. tenant name + "/" + domain id if the server has tenants.
+//
+//  GET    /admin/domains                     lists all domains with their members, age and expiry
+//  GET    /admin/domains/{key}               returns domain key
+//  DELETE /admin/domains/{key}               evicts all members of domain key, keeping its provision
+//  DELETE /admin/domains/{key}?member={id}   evicts the member with the ID or address id from domain key
+//  GET    /healthz                           liveness
+//  GET    /readyz                            readiness
+//  GET    /metrics                           Prometheus metrics, see server.MetricsHandler
+//
+// All of it works through the server.AddrStore, so domains registered with other servers sharing the store are
+// included.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+	})
+	mux.HandleFunc(ReadyPath, s.serveReadiness)
+	mux.Handle(MetricsPath, s.MetricsHandler())
+
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, s.AdminToken) {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "missing or invalid bearer token"})
+			return
+		}
+
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, AdminPath), "/")
+		member := r.URL.Query().Get("member")
+		switch {
+		case key == "" && r.Method == http.MethodGet:
+			s.listDomains(w)
+		case key != "" && r.Method == http.MethodGet:
+			s.writeDomain(w, http.StatusOK, key, key)
+		case key != "" && r.Method == http.MethodDelete && member != "":
+			s.evictMember(w, key, member)
+		case key != "" && r.Method == http.MethodDelete:
+			s.writeDeletion(w, key, s.evictDomain)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		}
+	})
+	mux.Handle(AdminPath, admin)
+	mux.Handle(AdminPath+"/", admin)
+
+	return mux
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+// listenAdmin serves the admin API at server.AdminAddr.
+func (s *Server) listenAdmin() {
+	s.serveHTTP(&http.Server{Addr: s.AdminAddr, Handler: s.AdminHandler(), TLSConfig: s.AdminTLS}, "admin api")
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(s.serving) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: "not serving"})
+		return
+	}
+	if _, err := s.AddrStore.Domains(); err != nil {
+		s.log.Error(err, "readiness check could not reach store")
+		writeJSON(w, http.StatusServiceUnavailable, statusResponse{Status: "store unavailable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, statusResponse{Status: "ok"})
+}
+
+func (s *Server) listDomains(w http.ResponseWriter) {
+	keys, err := s.AddrStore.Domains()
+	if err != nil {
+		s.log.Error(err, "could not list domains")
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+		return
+	}
+	sort.Strings(keys)
+
+	domains := make([]domainResponse, 0, len(keys))
+	for _, key := range keys {
+		resp, ok, err := s.describeDomain(key, key)
+		if err != nil {
+			s.log.Error(err, "could not describe domain", logKeyDomain, key)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+			return
+		}
+		if ok { // the domain may have been removed since listing it
+			domains = append(domains, resp)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, domains)
+}
+
+// evictMember removes the member with the ID or address id from the domain with key and notifies the remaining
+// members like after a leave.
+func (s *Server) evictMember(w http.ResponseWriter, key, id string) {
+	info, err := s.AddrStore.Describe(key)
+	if err != nil {
+		s.log.Error(err, "could not describe domain", logKeyDomain, key)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+		return
+	}
+
+	for _, m := range info.Members {
+		if m.ID != id && m.Addr != id {
+			continue
+		}
+
+		remaining, err := s.AddrStore.RemoveAddress(key, m)
+		if errors.Is(err, ErrUnknownMember) {
+			break // the member left in the meantime
+		}
+		if err != nil {
+			s.log.Error(err, "could not remove address", logKeyAddr, m.Addr)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+			return
+		}
+
+		s.log.V(1).Info("evicted member through admin api", logKeyAddr, m.Addr, logKeyID, m.ID, logKeyDomain, key)
+		s.notifyLeft(s.toPeers(remaining), s.toPeers([]Member{m}))
+		s.emitMember(EventMemberLeft, key, m, len(remaining))
+		if len(remaining) == 0 {
+			s.releaseDomain(key)
+			s.emit(Event{Type: EventDomainDeleted, Domain: key})
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown member"})
+}
+
+// evictDomain removes all members of the domain with key and tells each of them that the others left. Unlike
+// removeDomain, it keeps the provision of the domain, so the backend stays in charge of it. It reports whether the
+// domain had members.
+func (s *Server) evictDomain(key string) (bool, error) {
+	info, err := s.AddrStore.Describe(key)
+	if err != nil {
+		return false, err
+	}
+
+	removed := make([]Member, 0, len(info.Members))
+	for _, m := range info.Members {
+		_, err = s.AddrStore.RemoveAddress(key, m)
+		if errors.Is(err, ErrUnknownMember) {
+			err = nil
+			continue // the member left in the meantime
+		}
+		if err != nil {
+			break
+		}
+		removed = append(removed, m)
+		s.emitMember(EventMemberLeft, key, m, len(info.Members)-len(removed))
+	}
+
+	// the removed members are notified even if the store failed, as they are gone already
+	peers := s.toPeers(removed)
+	for i := range peers {
+		others := make([]protocol.Peer, 0, len(peers)-1)
+		others = append(others, peers[:i]...)
+		others = append(others, peers[i+1:]...)
+		s.notifyLeft(peers[i:i+1], others)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	if len(removed) > 0 {
+		s.releaseDomain(key)
+		s.log.V(1).Info("evicted domain through admin api", logKeyDomain, key)
+		s.emit(Event{Type: EventDomainDeleted, Domain: key})
+	}
+
+	return len(info.Members) > 0, nil
+}
+
+// authenticate reports whether r carries token as bearer token. If token is empty, all requests are rejected.
+func authenticate(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+func TestServer_AdminHandler(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AdminToken = "secret"
+	h := s.AdminHandler()
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d\n want %d for health", w.Code, http.StatusOK)
+	}
+	if w := do(http.MethodGet, "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d\n want %d for readiness before serving", w.Code, http.StatusServiceUnavailable)
+	}
+	atomic.StoreInt32(s.serving, 1)
+	if w := do(http.MethodGet, "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d\n want %d for readiness while serving", w.Code, http.StatusOK)
+	}
+	if w := do(http.MethodGet, "/admin/domains", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d\n want %d without token", w.Code, http.StatusUnauthorized)
+	}
+
+	for _, m := range []Member{{Addr: "127.0.0.1:33333"}, {Addr: "127.0.0.1:45433"}} {
+		if _, err := s.AddrStore.ProcessAddress("a", m, ProcessOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.AddrStore.ProcessAddress("b", Member{Addr: "143.92.93.227:33334"}, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := do(http.MethodGet, "/admin/domains", "secret")
+	var domains []domainResponse
+	if err := json.NewDecoder(w.Body).Decode(&domains); err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 || domains[0].Domain != "a" || len(domains[0].Members) != 2 || domains[0].Expires == nil {
+		t.Errorf("got %+v\n want domains a with 2 members and expiry and b", domains)
+	}
+
+	if w := do(http.MethodDelete, "/admin/domains/a?member=127.0.0.1:33333", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("got %d\n want %d for evicting member", w.Code, http.StatusNoContent)
+	}
+	if info, _ := s.AddrStore.Describe("a"); len(info.Members) != 1 {
+		t.Errorf("got %d\n want %d members after eviction", len(info.Members), 1)
+	}
+	if w := do(http.MethodDelete, "/admin/domains/a?member=127.0.0.1:33333", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d\n want %d for evicted member", w.Code, http.StatusNotFound)
+	}
+
+	if w := do(http.MethodDelete, "/admin/domains/b", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("got %d\n want %d for deleting domain", w.Code, http.StatusNoContent)
+	}
+	if w := do(http.MethodGet, "/admin/domains/b", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d\n want %d for deleted domain", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestServer_AdminHandler_EvictDomain(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AdminToken = "secret"
+	s.provisions.put("a", Provision{Domain: "a", Expires: time.Now().Add(time.Hour)})
+
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone)
+	for _, p := range peers {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("a"), ClientID: p.ID}, p.Addr, false)
+	}
+
+	r := httptest.NewRequest(http.MethodDelete, "/admin/domains/a", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got %d\n want %d for evicting domain", w.Code, http.StatusNoContent)
+	}
+
+	// each member learns that the other one left
+	for i, conn := range conns {
+		other := peers[1-i]
+		if got := receive(t, conn, protocol.TypePeerLeft); len(got.Peers) != 1 || got.Peers[0].ID != other.ID {
+			t.Errorf("got %v\n want %v to have left", got.Peers, other.ID)
+		}
+	}
+	if info, _ := s.AddrStore.Describe("a"); len(info.Members) != 0 {
+		t.Errorf("got %d\n want %d members after eviction", len(info.Members), 0)
+	}
+	if _, ok := s.provisions.get("a", time.Now()); !ok {
+		t.Errorf("got no provision\n want the provision to survive the eviction")
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BackendPath is the path the backend API is served at by server.ListenAndServe.
+const BackendPath = "/domains"
+
+// apiKeyHeader is the header selecting the tenant of a backend request if the server has tenants.
+const apiKeyHeader = "X-API-Key"
+
+// provisionRequest is the body of a request provisioning a domain.
+type provisionRequest struct {
+	Domain   string   `json:"domain"`
+	Size     int      `json:"size"`
+	Members  []string `json:"members"`
+	Topology Topology `json:"topology"`
+	// TTL is the lifetime of the provision as understood by time.ParseDuration, e.g. "10m".
+	TTL string `json:"ttl"`
+}
+
+// domainResponse is the state of a domain as returned by the backend API.
+type domainResponse struct {
+	Domain    string           `json:"domain"`
+	Provision *Provision       `json:"provision,omitempty"`
+	Members   []memberResponse `json:"members"`
+	Size      int              `json:"size,omitempty"`
+	Sealed    bool             `json:"sealed"`
+	Created   *time.Time       `json:"created,omitempty"`
+	// Age is the time since the first member registered in seconds.
+	Age float64 `json:"age,omitempty"`
+	// Expires is the time the domain is deleted unless its members send heartbeats.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type memberResponse struct {
+	ID       string    `json:"id,omitempty"`
+	Addr     string    `json:"addr"`
+	Index    int       `json:"index"`
+	Role     string    `json:"role"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// BackendHandler returns a http.Handler serving the backend API, which allows a backend, e.g. a matchmaker, to
+// provision domains ahead of time. Mount it at BackendPath on your own HTTPS server or set server.BackendAddr.
+// Every request must carry server.BackendToken as bearer token and, if the server has tenants, the API key of the
+// tenant in the X-API-Key header.
+//
+//  POST   /domains       provisions the domain of the JSON body, replacing its previous provision
+//  GET    /domains/{id}  returns the provision and the members of domain id
+//  DELETE /domains/{id}  removes the provision and all members of domain id
+//
+// The body of a provisioning request looks like this. Only domain and ttl are required:
+//
+//  {"domain": "match-42", "size": 2, "members": ["<uuid>", "<uuid>"], "topology": "mesh", "ttl": "10m"}
+func (s *Server) BackendHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, s.BackendToken) {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "missing or invalid bearer token"})
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, BackendPath), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			s.provisionDomain(w, r)
+		case id != "" && r.Method == http.MethodGet:
+			s.inspectDomain(w, r, id)
+		case id != "" && r.Method == http.MethodDelete:
+			s.deleteDomain(w, r, id)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+		}
+	})
+}
+
+// listenBackend serves the backend API at server.BackendAddr.
+func (s *Server) listenBackend() {
+	mux := http.NewServeMux()
+	mux.Handle(BackendPath, s.BackendHandler())
+	mux.Handle(BackendPath+"/", s.BackendHandler())
+	s.serveHTTP(&http.Server{Addr: s.BackendAddr, Handler: mux, TLSConfig: s.BackendTLS}, "backend api")
+}
+
+func (s *Server) provisionDomain(w http.ResponseWriter, r *http.Request) {
+	var req provisionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(64*s.MaxPacketSize))).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("could not decode body: %v", err)})
+		return
+	}
+	provision, err := req.provision(time.Now())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	// without join tokens, the server cannot tell the provisioned members from clients claiming their IDs
+	if len(provision.Members) > 0 && s.TokenVerifier == nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "members can only be provisioned if the server verifies join tokens"})
+		return
+	}
+
+	_, key, err := s.domainKey(r.Header.Get(apiKeyHeader), []byte(provision.Domain))
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: err.Error()})
+		return
+	}
+
+	s.provisions.put(key, provision)
+	s.log.V(1).Info("provisioned domain", logKeyDomain, key, "expires", provision.Expires)
+
+	s.writeDomain(w, http.StatusCreated, provision.Domain, key)
+}
+
+func (s *Server) inspectDomain(w http.ResponseWriter, r *http.Request, id string) {
+	_, key, err := s.domainKey(r.Header.Get(apiKeyHeader), []byte(id))
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: err.Error()})
+		return
+	}
+
+	s.writeDomain(w, http.StatusOK, id, key)
+}
+
+func (s *Server) deleteDomain(w http.ResponseWriter, r *http.Request, id string) {
+	_, key, err := s.domainKey(r.Header.Get(apiKeyHeader), []byte(id))
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, errorResponse{Error: err.Error()})
+		return
+	}
+
+	s.writeDeletion(w, key, s.removeDomain)
+}
+
+// writeDeletion deletes the domain with key in the server.AddrStore by remove and answers with the outcome.
+func (s *Server) writeDeletion(w http.ResponseWriter, key string, remove func(key string) (bool, error)) {
+	ok, err := remove(key)
+	if err != nil {
+		s.log.Error(err, "could not delete domain", logKeyDomain, key)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown domain"})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeDomain removes the provision and all members of the domain with key in the server.AddrStore. It reports
+// whether there was a provision or a member. The members are not notified.
+func (s *Server) removeDomain(key string) (bool, error) {
+	provisioned := s.provisions.remove(key)
+	info, err := s.AddrStore.Describe(key)
+	if err != nil {
+		return provisioned, err
+	}
+
+	for _, m := range info.Members {
+		if _, err := s.AddrStore.RemoveAddress(key, m); err != nil && !errors.Is(err, ErrUnknownMember) {
+			return true, err
+		}
+	}
+	s.releaseDomain(key)
+	s.log.V(1).Info("deleted domain", logKeyDomain, key)
+	if len(info.Members) > 0 {
+		s.emit(Event{Type: EventDomainDeleted, Domain: key})
+	}
+
+	return provisioned || len(info.Members) > 0, nil
+}
+
+// writeDomain answers with the state of domain id, which has key in the server.AddrStore.
+func (s *Server) writeDomain(w http.ResponseWriter, status int, id, key string) {
+	resp, ok, err := s.describeDomain(id, key)
+	if err != nil {
+		s.log.Error(err, "could not describe domain", logKeyDomain, key)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: errStoreFailure.Error()})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "unknown domain"})
+		return
+	}
+
+	writeJSON(w, status, resp)
+}
+
+// describeDomain returns the state of domain id, which has key in the server.AddrStore. It reports whether the
+// domain is provisioned or has members.
+func (s *Server) describeDomain(id, key string) (domainResponse, bool, error) {
+	info, err := s.AddrStore.Describe(key)
+	if err != nil {
+		return domainResponse{}, false, err
+	}
+
+	resp := domainResponse{Domain: id, Members: make([]memberResponse, 0, len(info.Members)), Size: info.Size, Sealed: info.Sealed}
+	if provision, ok := s.provisions.get(key, time.Now()); ok {
+		resp.Provision = &provision
+	}
+	if !info.Created.IsZero() {
+		resp.Created = &info.Created
+		resp.Age = time.Since(info.Created).Seconds()
+	}
+
+	var lastSeen time.Time
+	for _, m := range info.Members {
+		resp.Members = append(resp.Members, memberResponse{ID: m.ID, Addr: m.Addr, Index: m.Index, Role: m.Role.String(), LastSeen: m.LastSeen})
+		if m.LastSeen.After(lastSeen) {
+			lastSeen = m.LastSeen
+		}
+	}
+	if !lastSeen.IsZero() && s.MissedHeartbeats >= 0 {
+		expires := lastSeen.Add(time.Duration(s.MissedHeartbeats) * s.HeartbeatInterval)
+		resp.Expires = &expires
+	}
+
+	return resp, resp.Provision != nil || len(info.Members) > 0, nil
+}
+
+// provision validates r and returns the provision it requests.
+func (r provisionRequest) provision(now time.Time) (Provision, error) {
+	if r.Domain == "" {
+		return Provision{}, errors.New("domain is missing")
+	}
+	ttl, err := time.ParseDuration(r.TTL)
+	if err != nil || ttl <= 0 {
+		return Provision{}, fmt.Errorf("ttl %q is not a positive duration", r.TTL)
+	}
+	if r.Size < 0 || r.Size > 0 && len(r.Members) > r.Size {
+		return Provision{}, fmt.Errorf("size %d is negative or less than the %d members", r.Size, len(r.Members))
+	}
+	if r.Topology != TopologyAny && r.Topology != TopologyMesh && r.Topology != TopologyStar {
+		return Provision{}, fmt.Errorf("unknown topology %q", r.Topology)
+	}
+
+	members := make([]string, 0, len(r.Members))
+	for _, m := range r.Members {
+		id, err := protocol.ParseUUID(m)
+		if err != nil {
+			return Provision{}, fmt.Errorf("member %q: %v", m, err)
+		}
+		members = append(members, id.String())
+	}
+
+	return Provision{Domain: r.Domain, Size: r.Size, Members: members, Topology: r.Topology, Expires: now.Add(ttl)}, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_BackendHandler(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.BackendToken = "secret"
+	h := s.BackendHandler()
+
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(http.MethodGet, "/domains/match", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d\n want %d for wrong token", w.Code, http.StatusUnauthorized)
+	}
+	if w := do(http.MethodPost, "/domains", `{"domain": "match", "ttl": "-1m"}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d\n want %d for negative ttl", w.Code, http.StatusBadRequest)
+	}
+	if w := do(http.MethodGet, "/domains/match", "", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d\n want %d before provisioning", w.Code, http.StatusNotFound)
+	}
+	members := `{"domain": "match", "members": ["6ba7b810-9dad-11d1-80b4-00c04fd430c8"], "ttl": "1m"}`
+	if w := do(http.MethodPost, "/domains", members, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d\n want %d for members without token verifier", w.Code, http.StatusBadRequest)
+	}
+
+	w := do(http.MethodPost, "/domains", `{"domain": "match", "size": 2, "topology": "mesh", "ttl": "1m"}`, "secret")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d\n want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if _, err := s.AddrStore.ProcessAddress("match", Member{Addr: "143.92.93.227:33333"}, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w = do(http.MethodGet, "/domains/match", "", "secret")
+	var resp domainResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Provision == nil || resp.Provision.Size != 2 || len(resp.Members) != 1 {
+		t.Errorf("got %d %+v\n want %d with provision of size 2 and 1 member", w.Code, resp, http.StatusOK)
+	}
+
+	if w := do(http.MethodDelete, "/domains/match", "", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("got %d\n want %d", w.Code, http.StatusNoContent)
+	}
+	if info, _ := s.AddrStore.Describe("match"); len(info.Members) != 0 {
+		t.Errorf("got %d\n want %d members after delete", len(info.Members), 0)
+	}
+	if w := do(http.MethodGet, "/domains/match", "", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("got %d\n want %d after delete", w.Code, http.StatusNotFound)
+	}
+}
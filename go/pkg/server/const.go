@@ -2,5 +2,8 @@ package server
 
 const(
 	logKeyAddr = "address"
+	logKeyID = "id"
+	logKeyTenant = "tenant"
+	logKeyDomain = "domain"
 	udpNetworkName = "udp"
 )
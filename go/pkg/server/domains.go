@@ -1,23 +1,162 @@
 package server
 
 import (
-    "math"
+    "bytes"
+    "crypto/subtle"
+    "fmt"
+    "github.com/4kills/hole-punching/go/pkg/protocol"
     "sync"
     "time"
 )
 
+// Member is a client registered to a domain.
+type Member struct {
+    // ID is the persistent identity (UUID) of the client. It is empty for clients which registered without identity,
+    // e.g. legacy clients. Such members are identified by Addr alone.
+    ID string
+    // Addr is the endpoint (ip:port) of the client as seen by the server.
+    Addr string
+    // LastSeen is the time the client was last heard of, i.e. its latest registration or heartbeat. It is maintained
+    // by the AddressStore.
+    LastSeen time.Time
+    // Index is the position of the client in its domain, starting at 1. It is assigned by the AddressStore and
+    // stays the same while the client is a member, so all members agree on the order of the domain.
+    Index int
+    // Role is the role of the client in a star domain. Members of mesh domains have no role.
+    Role protocol.Role
+    // Metadata is the opaque blob the client attached to its registration. It is replaced when the client registers
+    // again and returned to the other members alongside the endpoint. It must not be modified.
+    Metadata []byte
+    // SecretHash is the SHA-256 hash of the secret the client registered with, which proves that a registration
+    // from another address belongs to the same client. It is nil if the client registered without secret.
+    SecretHash []byte
+}
+
+// sentBy reports whether m is the member which sent a message as o, i.e. o has the address of m and, if o has an
+// ID, the ID of m.
+func (m Member) sentBy(o Member) bool {
+    return m.Addr == o.Addr && (o.ID == "" || m.ID == o.ID)
+}
+
+// sameClient reports whether m and o belong to the same client, i.e. share a non-empty ID or have the same address.
+// Whether a client may move its ID to another address is decided by checkID.
+func (m Member) sameClient(o Member) bool {
+    return m.ID != "" && m.ID == o.ID || m.Addr == o.Addr
+}
+
+// ProcessOptions configure a call to AddressStore.ProcessAddress.
+type ProcessOptions struct {
+    // MaxMembers limits the number of members of the domain, including the processed member. Zero means no limit.
+    MaxMembers int
+    // Size is the number of members the processed member expects the complete domain to have, including itself.
+    // Zero means the member does not declare a size.
+    Size int
+    // VerifiedID reports that the ID of the processed member has been verified, e.g. by a join token bound to it.
+    // The member may then replace a member with the same ID registered from another address even if it does not
+    // carry the secret of that member.
+    VerifiedID bool
+}
+
+// Eviction lists the members evicted from a domain by AddressStore.Evict.
+type Eviction struct {
+    Domain string
+    Members []Member
+    // Remaining are the members left in the domain.
+    Remaining []Member
+}
+
+// Registration is the result of AddressStore.ProcessAddress.
+type Registration struct {
+    // Member is the stored member.
+    Member Member
+    // Others are all members of the domain except Member, ordered by Member.Index.
+    Others []Member
+    // Joined reports whether Member was not a member of the domain before, i.e. the registration is not a repeated
+    // registration of a member.
+    Joined bool
+    // Changed reports whether Member was a member before with another Member.Addr, Member.Role or Member.Metadata,
+    // i.e. the other members have to learn about the repeated registration.
+    Changed bool
+    // Created reports whether Member is the first member of the domain, i.e. the registration created it.
+    Created bool
+    // Size is the declared size of the domain, which may have been declared by another member. Zero means no size
+    // has been declared.
+    Size int
+    // Completed reports whether the registration made the domain reach its size, i.e. sealed it.
+    Completed bool
+}
+
+// DomainInfo is the state of a domain as returned by AddressStore.Describe.
+type DomainInfo struct {
+    // Members are the members of the domain ordered by Member.Index.
+    Members []Member
+    // Size is the declared size of the domain. Zero means no size has been declared.
+    Size int
+    // Sealed reports whether the domain has reached its size and does not admit new members.
+    Sealed bool
+    // Created is the time the first member of the domain registered.
+    Created time.Time
+}
+
 // AddressStore stores addresses with domain ids and allows to process those. AddressStore must be safe for concurrent use.
 type AddressStore interface {
-    // ProcessAddress takes a domain id (of peer connections) and returns all addresses registered to that id except addr.
-    // Furthermore, this method associates addr to id.
-    // All occurrences of addr should be removed in the returned slice, i.e. the return slice should not contain addr.
+    // ProcessAddress takes a domain id (of peer connections) and returns the stored m as well as all members
+    // registered to that id except m as Registration. Furthermore, this method associates m to id.
+    // Members with the same non-empty Member.ID or the same Member.Addr as m are the same client: they must be
+    // replaced by m and must not be contained in the returned slice.
     // An empty return slice is not an error case. A non-existent identifier should return an empty slice.
     //
+    // The members of a domain are ordered by Member.Index. A client which is already a member keeps its index,
+    // otherwise m is assigned the smallest index not in use by the domain.
+    //
     // This method should be safe for concurrent use.
     //
-    // ProcessAddress deletes addr from domain id after timeout if timeout is non-negative. If timeout is negative,
-    // nothing should be deleted.
-    ProcessAddress(id string, addr string, timeout time.Duration) ([]string, error)
+    // The registration counts as a heartbeat of m, i.e. the stored member has the current time as Member.LastSeen.
+    // If m is not yet a member and adding it would exceed a positive opts.MaxMembers, ErrDomainFull is returned and
+    // nothing is changed. While a star domain has no host, guests are rejected with ErrDomainFull once adding them
+    // would leave no room for the host within opts.MaxMembers or the size of the domain.
+    //
+    // A member with the ID of m but another address is replaced by m, e.g. after the client restarted with another
+    // port, if m has the non-empty Member.SecretHash of that member or opts.VerifiedID is set. Otherwise, ErrIDInUse
+    // is returned, so clients cannot take over the endpoints of others by sending their ID.
+    //
+    // The first positive opts.Size declared for a domain becomes its size. Declaring another size for the domain
+    // returns ErrSizeMismatch. Once the domain has as many members as its size, it is sealed: clients which are not
+    // yet members are rejected with ErrDomainSealed from then on.
+    //
+    // Registration.Joined, Registration.Created and Registration.Completed must be decided atomically with storing
+    // m, so concurrent registrations do not both count as joining, creating or completing the same domain.
+    //
+    // Domains whose members register with a Member.Role are star domains with at most one protocol.RoleHost. A
+    // second host or a member whose role does not match the kind of the domain is rejected with ErrRoleConflict.
+    // The store returns all members regardless of their role; it is up to the caller to hide them from guests.
+    // In all error cases nothing is changed.
+    ProcessAddress(id string, m Member, opts ProcessOptions) (Registration, error)
+
+    // RemoveAddress removes m from domain id immediately and returns the members remaining in that domain, keeping
+    // their order.
+    // Only the member with m.Addr is removed. If m.ID is non-empty, the ID of the member must match as well.
+    // If there is no such member, ErrUnknownMember is returned. Removing the last member removes the domain.
+    // This method must be safe for concurrent use with AddressStore.ProcessAddress.
+    RemoveAddress(id string, m Member) ([]Member, error)
+
+    // Heartbeat sets Member.LastSeen of m in domain id to the current time. The member is looked up like in
+    // RemoveAddress. If there is no such member, ErrUnknownMember is returned.
+    // This method must be safe for concurrent use with AddressStore.ProcessAddress.
+    Heartbeat(id string, m Member) error
+
+    // Evict removes all members whose Member.LastSeen is before deadline and returns them grouped by domain.
+    // Domains without members are removed.
+    // This method must be safe for concurrent use with AddressStore.ProcessAddress.
+    Evict(deadline time.Time) ([]Eviction, error)
+
+    // Describe returns the state of domain id without changing it. A non-existent domain yields a zero DomainInfo.
+    // This method must be safe for concurrent use with AddressStore.ProcessAddress.
+    Describe(id string) (DomainInfo, error)
+
+    // Domains returns the ids of all domains which have members, in no particular order.
+    // This method must be safe for concurrent use with AddressStore.ProcessAddress.
+    Domains() ([]string, error)
 
     // FetchAllAddresses returns all addresses currently in the address store as []string or an error.
     // This method must be safe for concurrent use with AddressStore.ProcessAddress.
@@ -25,12 +164,27 @@ type AddressStore interface {
 }
 
 type domainAddrMap struct {
-    m map[string][]string
+    m map[string][]Member
+    meta map[string]domainMeta
     mutex *sync.Mutex
-    allAddr []string
 }
 
-func (idm domainAddrMap) FetchAllAddresses() ([]string, error) {
+// domainMeta holds the state of a domain apart from its members.
+type domainMeta struct {
+    size int
+    sealed bool
+    created time.Time
+}
+
+func newDomainAddrMap() *domainAddrMap {
+    return &domainAddrMap{
+        m: make(map[string][]Member),
+        meta: make(map[string]domainMeta),
+        mutex: &sync.Mutex{},
+    }
+}
+
+func (idm *domainAddrMap) FetchAllAddresses() ([]string, error) {
     idm.mutex.Lock()
     defer idm.mutex.Unlock()
 
@@ -39,84 +193,256 @@ func (idm domainAddrMap) FetchAllAddresses() ([]string, error) {
         c += len(v)
     }
 
-    // reallocates array if it is nil, 4 times too large and larger than 1024 or if it doesn't suffice to store all addresses
-    if idm.allAddr == nil || (4 * c <= len(idm.allAddr) && c > 1024 || c > len(idm.allAddr)) {
-        n := math.Max(float64(c), 1024)
-        idm.allAddr = make([]string, 2 * int(n))
-    }
-
-    i := 0
+    // the addresses are used after unlocking, hence they must not share memory with the store
+    addrs := make([]string, 0, c)
     for _, v := range idm.m {
-        for _, addr := range v {
-            idm.allAddr[i] = addr
-            i++
+        for _, member := range v {
+            addrs = append(addrs, member.Addr)
         }
     }
 
-    return idm.allAddr[:c], nil
+    return addrs, nil
 }
 
-func (idm domainAddrMap) ProcessAddress(id, addr string, timeout time.Duration) ([]string, error) {
+func (idm *domainAddrMap) ProcessAddress(id string, m Member, opts ProcessOptions) (Registration, error) {
     idm.mutex.Lock()
     defer idm.mutex.Unlock()
 
-    defer func() {go idm.clear(id, addr, timeout)}()
-
-    var ret []string
+    var ret []Member
 
     s, ok := idm.m[id]
+    meta := idm.meta[id]
+    isMember := containsClient(s, m)
+    wasSealed := meta.sealed
+
+    if err := checkID(s, m, opts); err != nil {
+        return Registration{Member: m}, err
+    }
+    if err := checkRole(s, m); err != nil {
+        return Registration{Member: m}, err
+    }
+    if opts.Size > 0 && meta.size > 0 && opts.Size != meta.size {
+        return Registration{Member: m}, ErrSizeMismatch
+    }
+    if opts.Size > 0 {
+        meta.size = opts.Size
+    }
+    if !isMember {
+        if meta.sealed {
+            return Registration{Member: m}, ErrDomainSealed
+        }
+        // guests which register before the host of their domain must leave a slot for it
+        n := len(s)
+        if m.Role == protocol.RoleGuest && !hasHost(s) {
+            n++
+        }
+        if opts.MaxMembers > 0 && n >= opts.MaxMembers || meta.size > 0 && n >= meta.size {
+            return Registration{Member: m}, ErrDomainFull
+        }
+    }
+
+    m.LastSeen = time.Now()
+    if meta.created.IsZero() {
+        meta.created = m.LastSeen
+    }
+    defer func() {
+        meta.sealed = meta.size > 0 && len(idm.m[id]) >= meta.size
+        idm.meta[id] = meta
+    }()
+
     if !ok {
-        ret = make([]string, 1)
-        ret[0] = addr
+        m.Index = 1
+        ret = make([]Member, 1)
+        ret[0] = m
         idm.m[id] = ret
 
-        return ret[:0], nil
+        return Registration{Member: m, Others: ret[:0], Joined: true, Created: true, Size: meta.size, Completed: meta.size == 1}, nil
     }
 
-    ret = make([]string, len(s), len(s) + 1)
+    ret = make([]Member, 0, len(s) + 1)
+    m.Index = 0
 
-    i := 0
+    var prev Member
+    used := make(map[int]bool, len(s))
     for _, v := range s {
-        if v != addr {
-            ret[i] = v
-            i++
+        if !v.sameClient(m) {
+            ret = append(ret, v)
+            used[v.Index] = true
+        } else if m.Index == 0 {
+            m.Index = v.Index
+            prev = v
+        }
+    }
+    for i := 1; m.Index == 0; i++ {
+        if !used[i] {
+            m.Index = i
         }
     }
-    ret = ret[:i+1]
 
-    ret[i] = addr
+    // insert m keeping the order by index
+    i := len(ret)
+    for i > 0 && ret[i-1].Index > m.Index {
+        i--
+    }
+    ret = append(ret, Member{})
+    copy(ret[i+1:], ret[i:])
+    ret[i] = m
     idm.m[id] = ret
 
-    return ret[:i], nil
+    // copy as Heartbeat modifies the stored members
+    others := make([]Member, 0, len(ret) - 1)
+    others = append(others, ret[:i]...)
+    others = append(others, ret[i+1:]...)
+    completed := !wasSealed && meta.size > 0 && len(ret) >= meta.size
+    changed := isMember && (prev.Addr != m.Addr || prev.Role != m.Role || !bytes.Equal(prev.Metadata, m.Metadata))
+    return Registration{Member: m, Others: others, Joined: !isMember, Changed: changed, Size: meta.size, Completed: completed}, nil
 }
 
-// clear removes addr from domain id after timeout. If timeout is negative, clear is not
-// executed. If the last addr of a domain id is removed, the map key id is deleted altogether.
-func (idm domainAddrMap) clear(id string, addr string, timeout time.Duration) {
-    if timeout < 0 {
-        return
+func (idm *domainAddrMap) RemoveAddress(id string, m Member) ([]Member, error) {
+    idm.mutex.Lock()
+    defer idm.mutex.Unlock()
+
+    s := idm.m[id]
+
+    ret := make([]Member, 0, len(s))
+    for _, v := range s {
+        if !v.sentBy(m) {
+            ret = append(ret, v)
+        }
+    }
+    if len(ret) == len(s) {
+        return ret, ErrUnknownMember
+    }
+
+    if len(ret) == 0 {
+        delete(idm.m, id)
+        delete(idm.meta, id)
+        return ret, nil
+    }
+    idm.m[id] = ret
+
+    return append([]Member(nil), ret...), nil
+}
+
+// checkRole returns ErrRoleConflict if m cannot join the members s because of its role.
+func checkRole(s []Member, m Member) error {
+    for _, v := range s {
+        if v.sameClient(m) {
+            continue
+        }
+        if (v.Role == protocol.RoleNone) != (m.Role == protocol.RoleNone) {
+            return fmt.Errorf("%w: role %s in domain with role %s", ErrRoleConflict, m.Role, v.Role)
+        }
+        if v.Role == protocol.RoleHost && m.Role == protocol.RoleHost {
+            return fmt.Errorf("%w: domain already has a host", ErrRoleConflict)
+        }
     }
-    time.Sleep(timeout)
+    return nil
+}
 
+func (idm *domainAddrMap) Describe(id string) (DomainInfo, error) {
     idm.mutex.Lock()
     defer idm.mutex.Unlock()
 
-    s, ok := idm.m[id]
-    if !ok {
-        return
+    meta := idm.meta[id]
+    return DomainInfo{
+        Members: append([]Member(nil), idm.m[id]...),
+        Size: meta.size,
+        Sealed: meta.sealed,
+        Created: meta.created,
+    }, nil
+}
+
+func (idm *domainAddrMap) Domains() ([]string, error) {
+    idm.mutex.Lock()
+    defer idm.mutex.Unlock()
+
+    ids := make([]string, 0, len(idm.m))
+    for id := range idm.m {
+        ids = append(ids, id)
+    }
+
+    return ids, nil
+}
+
+// checkID returns ErrIDInUse if a member of s has the ID of m but another address, unless m carries the secret of
+// that member or opts.VerifiedID is set.
+func checkID(s []Member, m Member, opts ProcessOptions) error {
+    if m.ID == "" || opts.VerifiedID {
+        return nil
+    }
+
+    for _, v := range s {
+        if v.ID != m.ID || v.Addr == m.Addr {
+            continue
+        }
+        if len(v.SecretHash) == 0 || subtle.ConstantTimeCompare(v.SecretHash, m.SecretHash) != 1 {
+            return ErrIDInUse
+        }
     }
+    return nil
+}
 
-    for i := 0; i < len(s); i++ {
-        if addr == s[i] {
-            // remove addr
-            s[i] = s[len(s) - 1]
-            s = s[:len(s) - 1]
-            i-- // check same spot again in case addr is contained multiple times
+func hasHost(s []Member) bool {
+    for _, v := range s {
+        if v.Role == protocol.RoleHost {
+            return true
         }
     }
-    idm.m[id] = s
+    return false
+}
 
-    if len(s) == 0 {
-        delete(idm.m, id)
+func containsClient(s []Member, m Member) bool {
+    for _, v := range s {
+        if v.sameClient(m) {
+            return true
+        }
+    }
+    return false
+}
+
+func (idm *domainAddrMap) Heartbeat(id string, m Member) error {
+    idm.mutex.Lock()
+    defer idm.mutex.Unlock()
+
+    s := idm.m[id]
+    for i := range s {
+        if s[i].sentBy(m) {
+            s[i].LastSeen = time.Now()
+            return nil
+        }
+    }
+
+    return ErrUnknownMember
+}
+
+func (idm *domainAddrMap) Evict(deadline time.Time) ([]Eviction, error) {
+    idm.mutex.Lock()
+    defer idm.mutex.Unlock()
+
+    var evictions []Eviction
+    for id, s := range idm.m {
+        var evicted []Member
+        remaining := make([]Member, 0, len(s))
+        for _, v := range s {
+            if v.LastSeen.Before(deadline) {
+                evicted = append(evicted, v)
+            } else {
+                remaining = append(remaining, v)
+            }
+        }
+        if len(evicted) == 0 {
+            continue
+        }
+        evictions = append(evictions, Eviction{Domain: id, Members: evicted, Remaining: append([]Member(nil), remaining...)})
+
+        if len(remaining) == 0 {
+            delete(idm.m, id)
+            delete(idm.meta, id)
+            continue
+        }
+        idm.m[id] = remaining
     }
+
+    return evictions, nil
 }
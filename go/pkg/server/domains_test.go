@@ -1,105 +1,131 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
 	"testing"
+	"time"
 )
 
 func TestDomainAddrMap_ProcessAddress(t *testing.T) {
 	tt := []struct {
-		m map[string][]string
-		addr string
+		m map[string][]Member
+		member Member
+		opts ProcessOptions
 		domain string
-		expectedRet []string
-		expectedInner []string
+		expectedRet []Member
+		expectedInner []Member
 	}{
 		{
-			m: map[string][]string{
+			m: map[string][]Member{
 				"myDomain":{
-					"143.92.93.227:33333",
+					{Addr: "143.92.93.227:33333"},
 				},
 			},
-			addr: "47.123.241.125:45433",
+			member: Member{Addr: "47.123.241.125:45433"},
 			domain: "myDomain",
 
-			expectedRet: []string{
-				"143.92.93.227:33333",
+			expectedRet: []Member{
+				{Addr: "143.92.93.227:33333"},
 			},
-			expectedInner: []string{
-				"143.92.93.227:33333",
-				"47.123.241.125:45433",
+			expectedInner: []Member{
+				{Addr: "143.92.93.227:33333"},
+				{Addr: "47.123.241.125:45433"},
 			},
 		},
 		{
-			m: map[string][]string{
+			m: map[string][]Member{
 			},
-			addr: "47.123.241.125:45433",
+			member: Member{Addr: "47.123.241.125:45433"},
 			domain: "myDomain",
 
-			expectedRet: []string{
+			expectedRet: []Member{
 			},
-			expectedInner: []string{
-				"47.123.241.125:45433",
+			expectedInner: []Member{
+				{Addr: "47.123.241.125:45433"},
 			},
 		},
 		{
-			m: map[string][]string{
+			m: map[string][]Member{
 				"myDomain":{
 				},
 			},
-			addr: "47.123.241.125:45433",
+			member: Member{Addr: "47.123.241.125:45433"},
 			domain: "myDomain",
 
-			expectedRet: []string{
+			expectedRet: []Member{
 			},
-			expectedInner: []string{
-				"47.123.241.125:45433",
+			expectedInner: []Member{
+				{Addr: "47.123.241.125:45433"},
 			},
 		},
 		{
-			m: map[string][]string{
+			m: map[string][]Member{
 				"myDomain":{
-					"47.123.241.125:45433",
+					{Addr: "47.123.241.125:45433"},
 				},
 			},
-			addr: "47.123.241.125:45433",
+			member: Member{Addr: "47.123.241.125:45433"},
 			domain: "myDomain",
 
-			expectedRet: []string{
+			expectedRet: []Member{
 			},
-			expectedInner: []string{
-				"47.123.241.125:45433",
+			expectedInner: []Member{
+				{Addr: "47.123.241.125:45433"},
 			},
 		},
 		{
-			m: map[string][]string{
+			m: map[string][]Member{
 				"myDomain":{
-					"143.92.93.227:33333",
-					"47.123.241.125:45433",
+					{Addr: "143.92.93.227:33333"},
+					{Addr: "47.123.241.125:45433"},
 				},
 			},
-			addr: "47.123.241.125:45433",
+			member: Member{Addr: "47.123.241.125:45433"},
 			domain: "myDomain",
 
-			expectedRet: []string{
-				"143.92.93.227:33333",
+			expectedRet: []Member{
+				{Addr: "143.92.93.227:33333"},
 			},
-			expectedInner: []string{
-				"143.92.93.227:33333",
-				"47.123.241.125:45433",
+			expectedInner: []Member{
+				{Addr: "143.92.93.227:33333"},
+				{Addr: "47.123.241.125:45433"},
+			},
+		},
+		{
+			m: map[string][]Member{
+				"myDomain":{
+					{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"},
+					{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+				},
+			},
+			// a verified ID replaces the address of the member
+			member: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:40000"},
+			opts: ProcessOptions{VerifiedID: true},
+			domain: "myDomain",
+
+			expectedRet: []Member{
+				{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+			},
+			expectedInner: []Member{
+				{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+				{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:40000"},
 			},
 		},
 	}
 
 	for _, tc := range tt {
-		addrStore := domainAddrMap{m: tc.m}
+		addrStore := newDomainAddrMap()
+		addrStore.m = tc.m
 
-		s, err := addrStore.ProcessAddress(tc.domain, tc.addr, -1)
+		reg, err := addrStore.ProcessAddress(tc.domain, tc.member, tc.opts)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		if !strSliceEquals(s, tc.expectedRet) {
-			t.Errorf("got %v\n want %v", s, tc.expectedRet)
+		if !memberSliceEquals(reg.Others, tc.expectedRet) {
+			t.Errorf("got %v\n want %v", reg.Others, tc.expectedRet)
 		}
 
 		inner, ok := addrStore.m[tc.domain]
@@ -108,13 +134,410 @@ func TestDomainAddrMap_ProcessAddress(t *testing.T) {
 			continue
 		}
 
-		if !strSliceEquals(inner, tc.expectedInner) {
+		if !memberSliceEquals(inner, tc.expectedInner) {
 			t.Errorf("got %v\n want %v", inner, tc.expectedInner)
 		}
 	}
 }
 
-func strSliceEquals(got, want []string) bool {
+func TestDomainAddrMap_ProcessAddress_MaxMembers(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	addrStore.m["myDomain"] = []Member{
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"},
+		{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+	}
+	opts := ProcessOptions{MaxMembers: 2}
+
+	_, err := addrStore.ProcessAddress("myDomain", Member{Addr: "47.123.241.126:45433"}, opts)
+	if !errors.Is(err, ErrDomainFull) {
+		t.Errorf("got %v\n want %v", err, ErrDomainFull)
+	}
+
+	// existing members may register again
+	_, err = addrStore.ProcessAddress("myDomain", Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"}, opts)
+	if err != nil {
+		t.Errorf("got %v\n want %v", err, nil)
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_GuestsFirst(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	opts := ProcessOptions{Size: 3}
+
+	for _, addr := range []string{"47.123.241.125:45433", "47.123.241.126:45433"} {
+		if _, err := addrStore.ProcessAddress("myDomain", Member{Addr: addr, Role: protocol.RoleGuest}, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last slot is kept for the host
+	_, err := addrStore.ProcessAddress("myDomain", Member{Addr: "47.123.241.127:45433", Role: protocol.RoleGuest}, opts)
+	if !errors.Is(err, ErrDomainFull) {
+		t.Errorf("got %v\n want %v", err, ErrDomainFull)
+	}
+	reg, err := addrStore.ProcessAddress("myDomain", Member{Addr: "143.92.93.227:33333", Role: protocol.RoleHost}, opts)
+	if err != nil {
+		t.Fatalf("got %v\n want host to complete the domain", err)
+	}
+	if !reg.Completed {
+		t.Errorf("got %v\n want %v", reg.Completed, true)
+	}
+
+	// the same applies to the maximum number of members
+	addrStore = newDomainAddrMap()
+	opts = ProcessOptions{MaxMembers: 2}
+	if _, err := addrStore.ProcessAddress("other", Member{Addr: "47.123.241.125:45433", Role: protocol.RoleGuest}, opts); err != nil {
+		t.Fatal(err)
+	}
+	_, err = addrStore.ProcessAddress("other", Member{Addr: "47.123.241.126:45433", Role: protocol.RoleGuest}, opts)
+	if !errors.Is(err, ErrDomainFull) {
+		t.Errorf("got %v\n want %v", err, ErrDomainFull)
+	}
+	if _, err := addrStore.ProcessAddress("other", Member{Addr: "143.92.93.227:33333", Role: protocol.RoleHost}, opts); err != nil {
+		t.Errorf("got %v\n want host to join", err)
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_IDInUse(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	addrStore.m["myDomain"] = []Member{
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333", Index: 1, SecretHash: []byte("hash")},
+		{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433", Index: 2},
+	}
+
+	// a client sending the ID of another member must not take over its endpoint
+	for _, m := range []Member{
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.126:45433"},
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.126:45433", SecretHash: []byte("other hash")},
+		// members which registered without secret can only be moved with a verified ID
+		{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.126:45433"},
+	} {
+		_, err := addrStore.ProcessAddress("myDomain", m, ProcessOptions{})
+		if !errors.Is(err, ErrIDInUse) {
+			t.Errorf("got %v\n want %v for %v", err, ErrIDInUse, m)
+		}
+	}
+	want := []Member{
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"},
+		{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+	}
+	if !memberSliceEquals(addrStore.m["myDomain"], want) {
+		t.Errorf("got %v\n want %v", addrStore.m["myDomain"], want)
+	}
+
+	// the owner of the ID proves it by its secret, e.g. after a restart without token
+	_, err := addrStore.ProcessAddress("myDomain", Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.126:45433", SecretHash: []byte("hash")}, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[0].Addr = "47.123.241.126:45433"
+	if !memberSliceEquals(addrStore.m["myDomain"], want) {
+		t.Errorf("got %v\n want %v", addrStore.m["myDomain"], want)
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_Changed(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	id := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	for _, tc := range []struct {
+		member  Member
+		opts    ProcessOptions
+		joined  bool
+		changed bool
+	}{
+		{member: Member{ID: id, Addr: "143.92.93.227:33333"}, joined: true},
+		{member: Member{ID: id, Addr: "143.92.93.227:33333"}},
+		{member: Member{ID: id, Addr: "143.92.93.227:33333", Metadata: []byte("v2")}, changed: true},
+		{member: Member{ID: id, Addr: "143.92.93.227:33333", Metadata: []byte("v2")}},
+		{member: Member{ID: id, Addr: "143.92.93.227:40000", Metadata: []byte("v2")}, opts: ProcessOptions{VerifiedID: true}, changed: true},
+	} {
+		reg, err := addrStore.ProcessAddress("myDomain", tc.member, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.Joined != tc.joined || reg.Changed != tc.changed {
+			t.Errorf("got joined %v, changed %v\n want joined %v, changed %v for %v", reg.Joined, reg.Changed, tc.joined, tc.changed, tc.member)
+		}
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_Index(t *testing.T) {
+	addrStore := newDomainAddrMap()
+
+	tt := []struct {
+		member     Member
+		wantIndex  int
+		wantRet    []int
+		wantJoined bool
+	}{
+		{member: Member{Addr: "143.92.93.227:33333"}, wantIndex: 1, wantRet: []int{}, wantJoined: true},
+		{member: Member{Addr: "47.123.241.125:45433"}, wantIndex: 2, wantRet: []int{1}, wantJoined: true},
+		{member: Member{Addr: "47.123.241.126:45433"}, wantIndex: 3, wantRet: []int{1, 2}, wantJoined: true},
+		// members keep their index when registering again
+		{member: Member{Addr: "143.92.93.227:33333"}, wantIndex: 1, wantRet: []int{2, 3}, wantJoined: false},
+	}
+
+	for i, tc := range tt {
+		reg, err := addrStore.ProcessAddress("myDomain", tc.member, ProcessOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.Member.Index != tc.wantIndex {
+			t.Errorf("got %v\n want %v", reg.Member.Index, tc.wantIndex)
+		}
+		if got := memberIndices(reg.Others); !intSliceEquals(got, tc.wantRet) {
+			t.Errorf("got %v\n want %v", got, tc.wantRet)
+		}
+		if reg.Joined != tc.wantJoined {
+			t.Errorf("got joined %v\n want %v", reg.Joined, tc.wantJoined)
+		}
+		if reg.Created != (i == 0) {
+			t.Errorf("got created %v\n want %v", reg.Created, i == 0)
+		}
+	}
+
+	// the smallest free index is reused
+	if _, err := addrStore.RemoveAddress("myDomain", Member{Addr: "47.123.241.125:45433"}); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := addrStore.ProcessAddress("myDomain", Member{Addr: "47.123.241.127:45433"}, ProcessOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Member.Index != 2 {
+		t.Errorf("got %v\n want %v", reg.Member.Index, 2)
+	}
+	if got, want := memberIndices(addrStore.m["myDomain"]), []int{1, 2, 3}; !intSliceEquals(got, want) {
+		t.Errorf("got %v\n want %v", got, want)
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_Role(t *testing.T) {
+	addrStore := newDomainAddrMap()
+
+	tt := []struct {
+		member  Member
+		wantErr error
+	}{
+		{member: Member{Addr: "143.92.93.227:33333", Role: protocol.RoleGuest}},
+		{member: Member{Addr: "47.123.241.125:45433", Role: protocol.RoleHost}},
+		// a star domain has a single host and no members without role
+		{member: Member{Addr: "47.123.241.126:45433", Role: protocol.RoleHost}, wantErr: ErrRoleConflict},
+		{member: Member{Addr: "47.123.241.126:45433"}, wantErr: ErrRoleConflict},
+		{member: Member{Addr: "47.123.241.126:45433", Role: protocol.RoleGuest}},
+		// the host may register again
+		{member: Member{Addr: "47.123.241.125:45433", Role: protocol.RoleHost}},
+	}
+
+	for _, tc := range tt {
+		_, err := addrStore.ProcessAddress("myDomain", tc.member, ProcessOptions{})
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("got %v\n want %v", err, tc.wantErr)
+		}
+	}
+
+	// mesh domains do not admit members with role
+	if _, err := addrStore.ProcessAddress("otherDomain", Member{Addr: "143.92.93.227:33333"}, ProcessOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addrStore.ProcessAddress("otherDomain", Member{Addr: "47.123.241.125:45433", Role: protocol.RoleGuest}, ProcessOptions{}); !errors.Is(err, ErrRoleConflict) {
+		t.Errorf("got %v\n want %v", err, ErrRoleConflict)
+	}
+}
+
+func TestDomainAddrMap_Describe(t *testing.T) {
+	addrStore := newDomainAddrMap()
+
+	info, err := addrStore.Describe("myDomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Members) != 0 || info.Size != 0 || info.Sealed || !info.Created.IsZero() {
+		t.Errorf("got %+v\n want zero DomainInfo", info)
+	}
+
+	opts := ProcessOptions{Size: 2}
+	for _, m := range []Member{{Addr: "143.92.93.227:33333"}, {Addr: "47.123.241.125:45433"}} {
+		if _, err := addrStore.ProcessAddress("myDomain", m, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err = addrStore.Describe("myDomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Member{{Addr: "143.92.93.227:33333"}, {Addr: "47.123.241.125:45433"}}
+	if !memberSliceEquals(info.Members, want) {
+		t.Errorf("got %v\n want %v", info.Members, want)
+	}
+	if info.Size != 2 || !info.Sealed || info.Created.IsZero() {
+		t.Errorf("got %+v\n want size 2, sealed and created", info)
+	}
+}
+
+func TestDomainAddrMap_Domains(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	for _, id := range []string{"a", "b", "a"} {
+		if _, err := addrStore.ProcessAddress(id, Member{Addr: "143.92.93.227:33333"}, ProcessOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := addrStore.RemoveAddress("b", Member{Addr: "143.92.93.227:33333"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := addrStore.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("got %v\n want %v", ids, []string{"a"})
+	}
+}
+
+func TestDomainAddrMap_FetchAllAddresses(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	for i := 0; i < 1500; i++ {
+		m := Member{Addr: fmt.Sprintf("143.92.%d.%d:33333", i/256, i%256)}
+		if _, err := addrStore.ProcessAddress(fmt.Sprint(i%10), m, ProcessOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	addrs, err := addrStore.FetchAllAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1500 {
+		t.Errorf("got %d addresses\n want 1500", len(addrs))
+	}
+
+	// the returned addresses are not overwritten by the next call
+	addrs[0] = ""
+	again, err := addrStore.FetchAllAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range again {
+		if addr == "" {
+			t.Fatal("got address changed by the caller of a previous call")
+		}
+	}
+}
+
+func TestDomainAddrMap_RemoveAddress(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	addrStore.m["myDomain"] = []Member{
+		{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"},
+		{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"},
+	}
+
+	// the ID must match the address
+	_, err := addrStore.RemoveAddress("myDomain", Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"})
+	if !errors.Is(err, ErrUnknownMember) {
+		t.Errorf("got %v\n want %v", err, ErrUnknownMember)
+	}
+
+	remaining, err := addrStore.RemoveAddress("myDomain", Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Member{{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Addr: "47.123.241.125:45433"}}
+	if !memberSliceEquals(remaining, want) {
+		t.Errorf("got %v\n want %v", remaining, want)
+	}
+
+	_, err = addrStore.RemoveAddress("myDomain", Member{Addr: "47.123.241.125:45433"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := addrStore.m["myDomain"]; ok {
+		t.Errorf("got %v\n want %v", ok, false)
+	}
+}
+
+func TestDomainAddrMap_ProcessAddress_Size(t *testing.T) {
+	addrStore := newDomainAddrMap()
+	opts := ProcessOptions{Size: 2}
+
+	tt := []struct {
+		member        Member
+		opts          ProcessOptions
+		wantErr       error
+		wantCompleted bool
+	}{
+		{member: Member{Addr: "143.92.93.227:33333"}, opts: opts},
+		{member: Member{Addr: "47.123.241.125:45433"}, opts: ProcessOptions{Size: 3}, wantErr: ErrSizeMismatch},
+		// members not declaring a size complete the domain as well
+		{member: Member{Addr: "47.123.241.125:45433"}, opts: ProcessOptions{}, wantCompleted: true},
+		// the domain is complete and sealed now
+		{member: Member{Addr: "47.123.241.126:45433"}, opts: opts, wantErr: ErrDomainSealed},
+		{member: Member{Addr: "47.123.241.126:45433"}, opts: ProcessOptions{}, wantErr: ErrDomainSealed},
+		// members may register again
+		{member: Member{Addr: "47.123.241.125:45433"}, opts: opts},
+	}
+
+	for _, tc := range tt {
+		reg, err := addrStore.ProcessAddress("myDomain", tc.member, tc.opts)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("got %v\n want %v", err, tc.wantErr)
+		}
+		if err == nil && (reg.Size != 2 || reg.Completed != tc.wantCompleted) {
+			t.Errorf("got size %d, completed %v\n want 2, %v", reg.Size, reg.Completed, tc.wantCompleted)
+		}
+	}
+
+	if _, err := addrStore.RemoveAddress("myDomain", Member{Addr: "143.92.93.227:33333"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addrStore.ProcessAddress("myDomain", Member{Addr: "47.123.241.126:45433"}, opts); !errors.Is(err, ErrDomainSealed) {
+		t.Errorf("got %v\n want %v", err, ErrDomainSealed)
+	}
+}
+
+func TestDomainAddrMap_Evict(t *testing.T) {
+	now := time.Now()
+	addrStore := newDomainAddrMap()
+	addrStore.m["myDomain"] = []Member{
+		{Addr: "143.92.93.227:33333", LastSeen: now.Add(-time.Minute)},
+		{Addr: "47.123.241.125:45433", LastSeen: now},
+	}
+	addrStore.m["otherDomain"] = []Member{
+		{Addr: "47.123.241.126:45433", LastSeen: now.Add(-time.Minute)},
+		{Addr: "47.123.241.127:45433", LastSeen: now},
+	}
+
+	if err := addrStore.Heartbeat("myDomain", Member{Addr: "143.92.93.227:33333"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := addrStore.Heartbeat("myDomain", Member{Addr: "47.123.241.126:45433"}); !errors.Is(err, ErrUnknownMember) {
+		t.Errorf("got %v\n want %v", err, ErrUnknownMember)
+	}
+
+	evictions, err := addrStore.Evict(now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evictions) != 1 || evictions[0].Domain != "otherDomain" {
+		t.Fatalf("got %v\n want eviction of otherDomain", evictions)
+	}
+	if want := []Member{{Addr: "47.123.241.126:45433"}}; !memberSliceEquals(evictions[0].Members, want) {
+		t.Errorf("got %v\n want %v", evictions[0].Members, want)
+	}
+	if want := []Member{{Addr: "47.123.241.127:45433"}}; !memberSliceEquals(evictions[0].Remaining, want) {
+		t.Errorf("got %v\n want %v", evictions[0].Remaining, want)
+	}
+	if want := evictions[0].Remaining; !memberSliceEquals(addrStore.m["otherDomain"], want) {
+		t.Errorf("got %v\n want %v", addrStore.m["otherDomain"], want)
+	}
+	if got := len(addrStore.m["myDomain"]); got != 2 {
+		t.Errorf("got %v\n want %v", got, 2)
+	}
+}
+
+func memberSliceEquals(got, want []Member) bool {
 	if got == nil && want == nil {
 		return true
 	}
@@ -122,6 +545,29 @@ func strSliceEquals(got, want []string) bool {
 		return false
 	}
 
+	for i := range got {
+		if got[i].ID != want[i].ID || got[i].Addr != want[i].Addr {
+			return false
+		}
+	}
+
+	return true
+}
+
+func memberIndices(members []Member) []int {
+	indices := make([]int, len(members))
+	for i, m := range members {
+		indices[i] = m.Index
+	}
+
+	return indices
+}
+
+func intSliceEquals(got, want []int) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
 	for i := range got {
 		if got[i] != want[i] {
 			return false
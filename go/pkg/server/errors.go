@@ -0,0 +1,43 @@
+package server
+
+import "errors"
+
+var (
+	// ErrDomainFull is returned by AddressStore.ProcessAddress if adding a member would exceed
+	// ProcessOptions.MaxMembers.
+	ErrDomainFull = errors.New("domain is full")
+	// ErrDomainSealed is returned by AddressStore.ProcessAddress if the domain has reached its declared size and
+	// does not admit new members anymore.
+	ErrDomainSealed = errors.New("domain is sealed")
+	// ErrSizeMismatch is returned by AddressStore.ProcessAddress if the declared size differs from the size of the
+	// domain.
+	ErrSizeMismatch = errors.New("declared size does not match size of domain")
+	// ErrRoleConflict is returned by AddressStore.ProcessAddress if the role of the member does not fit the domain,
+	// e.g. because the domain already has a host or mixes members with and without role.
+	ErrRoleConflict = errors.New("role conflicts with domain")
+	// ErrIDInUse is returned by AddressStore.ProcessAddress if another address is registered with the ID of the member
+	// and neither the secret of the member nor ProcessOptions.VerifiedID proves that it is the same client.
+	ErrIDInUse = errors.New("client id is registered from another address")
+	// ErrUnknownMember is returned by AddressStore.RemoveAddress if the member to remove is not registered.
+	ErrUnknownMember = errors.New("unknown member")
+	// ErrUnauthorized is returned if a registration lacks a valid join token for its domain.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnknownTenant is returned by TenantStore.Tenant if no tenant has the API key.
+	ErrUnknownTenant = errors.New("unknown tenant")
+	// ErrQuotaExceeded is returned if a registration would exceed a quota of its tenant.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrNotProvisioned is returned if server.RequireProvisioning is set and a registration refers to a domain
+	// which has not been provisioned.
+	ErrNotProvisioned = errors.New("domain not provisioned")
+	// ErrServerClosed is returned by server.ListenAndServe after a call to server.Shutdown or server.Close.
+	ErrServerClosed = errors.New("server closed")
+	// ErrInvalidConfig is returned by New and server.ListenAndServe if the configuration of the server is invalid.
+	ErrInvalidConfig = errors.New("invalid configuration")
+
+	// reasons of error responses which have no counterpart in the API
+	errRateLimited      = errors.New("rate limit exceeded")
+	errPacketTooLarge   = errors.New("packet too large")
+	errMetadataTooLarge = errors.New("metadata too large")
+	// errStoreFailure hides the internal error of the store from clients
+	errStoreFailure = errors.New("could not store registration")
+)
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MetricsPath is the path the metrics are served at by server.AdminHandler.
+const MetricsPath = "/metrics"
+
+const metricsNamespace = "rendezvous"
+
+// reasons packets are dropped for, used as label of the dropped packets metric
+const (
+	dropRateLimited    = "rate_limited"
+	dropOversized      = "oversized"
+	dropLegacyDisabled = "legacy_disabled"
+	dropMalformed      = "malformed"
+)
+
+// metrics are the Prometheus metrics of a server. The per tenant metrics are labelled with the name of the tenant,
+// which is empty if the server has no tenants.
+type metrics struct {
+	registry *prometheus.Registry
+
+	packetsReceived  prometheus.Counter
+	packetsDropped   *prometheus.CounterVec
+	processErrors    *prometheus.CounterVec
+	processDuration  *prometheus.HistogramVec
+	keepAlivesSent   prometheus.Counter
+	keepAlivesFailed prometheus.Counter
+	completion       *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		packetsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "packets_received_total",
+			Help:      "Packets received over UDP.",
+		}),
+		packetsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "packets_dropped_total",
+			Help:      "Packets dropped before being handled by reason, e.g. oversized for packets exceeding the maximum packet size.",
+		}, []string{"reason"}),
+		processErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "process_address_errors_total",
+			Help:      "Registrations the address store did not process by tenant.",
+		}, []string{"tenant"}),
+		processDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "process_address_duration_seconds",
+			Help:      "Latency of processing registrations in the address store by tenant.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"tenant"}),
+		keepAlivesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "keep_alives_sent_total",
+			Help:      "Keep alive packets sent.",
+		}),
+		keepAlivesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "keep_alives_failed_total",
+			Help:      "Keep alive packets which could not be sent.",
+		}),
+		completion: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "domain_completion_seconds",
+			Help:      "Time from the first registration with a domain until it reached its expected size by tenant.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		}, []string{"tenant"}),
+	}
+
+	m.registry.MustRegister(m.packetsReceived, m.packetsDropped, m.processErrors, m.processDuration,
+		m.keepAlivesSent, m.keepAlivesFailed, m.completion)
+	return m
+}
+
+// MetricsHandler returns a http.Handler serving the Prometheus metrics of the server. It is served at MetricsPath by
+// server.AdminHandler as well.
+func (s *Server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// domainCollector collects the active domains and members by tenant from the server.AddrStore on every scrape.
+type domainCollector struct {
+	s       *Server
+	domains *prometheus.Desc
+	members *prometheus.Desc
+}
+
+func newDomainCollector(s *Server) domainCollector {
+	return domainCollector{
+		s:       s,
+		domains: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "domains"), "Domains with members by tenant.", []string{"tenant"}, nil),
+		members: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "members"), "Registered members by tenant.", []string{"tenant"}, nil),
+	}
+}
+
+func (c domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.domains
+	ch <- c.members
+}
+
+func (c domainCollector) Collect(ch chan<- prometheus.Metric) {
+	keys, err := c.s.AddrStore.Domains()
+	if err != nil {
+		c.s.log.Error(err, "could not list domains for metrics")
+		return
+	}
+
+	domains := make(map[string]int)
+	members := make(map[string]int)
+	for _, key := range keys {
+		info, err := c.s.AddrStore.Describe(key)
+		if err != nil {
+			c.s.log.Error(err, "could not describe domain for metrics", logKeyDomain, key)
+			continue
+		}
+		tenant := c.s.tenantOf(key)
+		domains[tenant]++
+		members[tenant] += len(info.Members)
+	}
+
+	for tenant, n := range domains {
+		ch <- prometheus.MustNewConstMetric(c.domains, prometheus.GaugeValue, float64(n), tenant)
+		ch <- prometheus.MustNewConstMetric(c.members, prometheus.GaugeValue, float64(members[tenant]), tenant)
+	}
+}
+
+// tenantOf returns the name of the tenant of the domain with key in the server.AddrStore.
+func (s *Server) tenantOf(key string) string {
+	if s.Tenants == nil {
+		return ""
+	}
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// observeCompletion records the completion of the domain with key.
+func (s *Server) observeCompletion(tenant, key string) {
+	info, err := s.AddrStore.Describe(key)
+	if err != nil || info.Created.IsZero() {
+		return
+	}
+	s.metrics.completion.WithLabelValues(tenant).Observe(time.Since(info.Created).Seconds())
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.metrics.registry.Register(newDomainCollector(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	s.handlePacket([]byte{protocol.Magic, 0xff, 0x01}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33333})
+	for i, port := range []int{33333, 45433} {
+		id := protocol.UUID{byte(i + 1)}
+		msg := protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: id, Size: 2}
+		s.handleConnection(msg, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, false)
+	}
+
+	families, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		got[f.GetName()] = f
+	}
+
+	if f := got["rendezvous_packets_dropped_total"]; f == nil || f.Metric[0].GetCounter().GetValue() != 1 {
+		t.Errorf("got %v\n want 1 dropped packet", f)
+	}
+	if f := got["rendezvous_process_address_duration_seconds"]; f == nil || f.Metric[0].GetHistogram().GetSampleCount() != 2 {
+		t.Errorf("got %v\n want 2 processed registrations", f)
+	}
+	if f := got["rendezvous_domain_completion_seconds"]; f == nil || f.Metric[0].GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("got %v\n want 1 completed domain", f)
+	}
+	if f := got["rendezvous_members"]; f == nil || f.Metric[0].GetGauge().GetValue() != 2 {
+		t.Errorf("got %v\n want 2 members", f)
+	}
+}
+
+func TestServer_Metrics_CompletionOnce(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// registrations of members are repeated, e.g. because the answer got lost
+	for _, i := range []int{0, 1, 1, 0} {
+		msg := protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: protocol.UUID{byte(i + 1)}, Size: 2}
+		s.handleConnection(msg, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33333 + i}, false)
+	}
+
+	families, err := s.metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "rendezvous_domain_completion_seconds" {
+			if got := f.Metric[0].GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("got %d completed domains\n want 1", got)
+			}
+			return
+		}
+	}
+	t.Error("got no completed domain\n want 1")
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+// notifyPeers pushes the newly registered joined peer to all peers of its domain which see it. Legacy peers cannot
+// decode framed messages and receive their complete list of peers instead.
+func (s *Server) notifyPeers(peers []protocol.Peer, joined protocol.Peer) {
+	msg := protocol.Message{Type: protocol.TypePeerJoined, Peers: []protocol.Peer{joined}}
+
+	for i, peer := range peers {
+		if !peer.Role.Sees(joined.Role) {
+			continue
+		}
+		if _, ok := s.legacyAddrs.Load(peer.Addr.String()); !ok {
+			s.send(peer.Addr, msg)
+			continue
+		}
+
+		list := make([]protocol.Peer, 0, len(peers))
+		list = append(list, peers[:i]...)
+		list = append(list, peers[i+1:]...)
+		list = append(list, joined)
+		s.write(peer.Addr, protocol.EncodeLegacyPeers(list))
+	}
+}
+
+// announceReady sends the final list of peers to every member of a complete domain. If a member registers again
+// after completion, e.g. after a restart, the announcement is repeated.
+func (s *Server) announceReady(members []protocol.Peer) {
+	for i, member := range members {
+		peers := make([]protocol.Peer, 0, len(members)-1)
+		peers = append(peers, members[:i]...)
+		peers = append(peers, members[i+1:]...)
+		peers = visibleTo(member.Role, peers)
+
+		if _, ok := s.legacyAddrs.Load(member.Addr.String()); ok {
+			s.write(member.Addr, protocol.EncodeLegacyPeers(peers))
+			continue
+		}
+		s.send(member.Addr, protocol.Message{Type: protocol.TypeReady, Peers: peers, Index: member.Index})
+	}
+}
+
+// notifyLeft pushes the peers which left a domain to the remaining peers. Legacy peers cannot decode framed messages
+// and receive their complete list of peers instead.
+func (s *Server) notifyLeft(remaining []protocol.Peer, left []protocol.Peer) {
+	for i, peer := range remaining {
+		seen := visibleTo(peer.Role, left)
+		if len(seen) == 0 {
+			continue
+		}
+		if _, ok := s.legacyAddrs.Load(peer.Addr.String()); !ok {
+			s.send(peer.Addr, protocol.Message{Type: protocol.TypePeerLeft, Peers: seen})
+			continue
+		}
+
+		list := make([]protocol.Peer, 0, len(remaining)-1)
+		list = append(list, remaining[:i]...)
+		list = append(list, remaining[i+1:]...)
+		s.write(peer.Addr, protocol.EncodeLegacyPeers(list))
+	}
+}
+
+// visibleTo returns the peers a member with role r sees. In star domains, guests only see the host.
+func visibleTo(r protocol.Role, peers []protocol.Peer) []protocol.Peer {
+	visible := make([]protocol.Peer, 0, len(peers))
+	for _, p := range peers {
+		if r.Sees(p.Role) {
+			visible = append(visible, p)
+		}
+	}
+
+	return visible
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+// receiveLegacy returns the peers of the next legacy packet received by conn.
+func receiveLegacy(t *testing.T, conn *net.UDPConn) []protocol.Peer {
+	t.Helper()
+	buf := make([]byte, 0xffff)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("waiting for legacy peers: %v", err)
+	}
+	peers, err := protocol.DecodeLegacyPeers(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+// receiveNone fails t if conn receives a packet within a short time.
+func receiveNone(t *testing.T, conn *net.UDPConn) {
+	t.Helper()
+	buf := make([]byte, 0xffff)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		msg, _ := protocol.Unmarshal(buf[:n])
+		t.Errorf("got %v\n want no packet", msg)
+	}
+}
+
+// listenPeers returns a socket for each of roles as well as the peers they stand in for.
+func listenPeers(t *testing.T, roles ...protocol.Role) ([]*net.UDPConn, []protocol.Peer) {
+	conns := make([]*net.UDPConn, len(roles))
+	peers := make([]protocol.Peer, len(roles))
+	for i, role := range roles {
+		var addr *net.UDPAddr
+		conns[i], addr = listenMember(t)
+		peers[i] = protocol.Peer{ID: protocol.UUID{byte(i + 1)}, Addr: addr, Index: i + 1, Role: role}
+	}
+	return conns, peers
+}
+
+func TestServer_NotifyPeers(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone)
+	s.legacyAddrs.Store(peers[1].Addr.String(), struct{}{})
+	s.notifyPeers(peers[:2], peers[2])
+
+	if got := receive(t, conns[0], protocol.TypePeerJoined); len(got.Peers) != 1 || got.Peers[0].ID != peers[2].ID {
+		t.Errorf("got %v\n want %v", got.Peers, peers[2:])
+	}
+	if got := receiveLegacy(t, conns[1]); len(got) != 2 || got[0].Addr.String() != peers[0].Addr.String() ||
+		got[1].Addr.String() != peers[2].Addr.String() {
+		t.Errorf("got %v\n want the complete list of peers for legacy peer", got)
+	}
+	receiveNone(t, conns[2])
+}
+
+func TestServer_NotifyPeers_Star(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conns, peers := listenPeers(t, protocol.RoleHost, protocol.RoleGuest, protocol.RoleGuest)
+	s.notifyPeers(peers[:2], peers[2])
+
+	if got := receive(t, conns[0], protocol.TypePeerJoined); len(got.Peers) != 1 || got.Peers[0].ID != peers[2].ID {
+		t.Errorf("got %v\n want %v for host", got.Peers, peers[2:])
+	}
+	receiveNone(t, conns[1])
+}
+
+func TestServer_AnnounceReady(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conns, peers := listenPeers(t, protocol.RoleHost, protocol.RoleGuest, protocol.RoleGuest)
+	s.legacyAddrs.Store(peers[2].Addr.String(), struct{}{})
+	s.announceReady(peers)
+
+	if got := receive(t, conns[0], protocol.TypeReady); len(got.Peers) != 2 || got.Index != 1 {
+		t.Errorf("got %v with index %d\n want both guests with index %d for host", got.Peers, got.Index, 1)
+	}
+	if got := receive(t, conns[1], protocol.TypeReady); len(got.Peers) != 1 || got.Peers[0].ID != peers[0].ID || got.Index != 2 {
+		t.Errorf("got %v with index %d\n want only the host with index %d for guest", got.Peers, got.Index, 2)
+	}
+	if got := receiveLegacy(t, conns[2]); len(got) != 1 || got[0].Addr.String() != peers[0].Addr.String() {
+		t.Errorf("got %v\n want only the host for legacy guest", got)
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-logr/logr"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Option configures a Server constructed by New. It returns an error wrapping ErrInvalidConfig if its arguments are
+// invalid.
+type Option func(*Server) error
+
+// WithLogger sets the logr.Logger of the server.
+func WithLogger(logger logr.Logger) Option {
+	return func(s *Server) error {
+		if logger.GetSink() == nil {
+			return fmt.Errorf("%w: logger has no sink", ErrInvalidConfig)
+		}
+		s.log = logger
+		return nil
+	}
+}
+
+// WithKeepAlive sets the time after which an address receives a keep alive packet in order to keep the NAT mapping
+// intact. If t is negative, keep alive packets are disabled. Otherwise, t must be at least 1 s.
+func WithKeepAlive(t time.Duration) Option {
+	return func(s *Server) error {
+		if 0 <= t && t < time.Second {
+			return fmt.Errorf("%w: keep alive of %v is less than 1s", ErrInvalidConfig, t)
+		}
+		s.keepAlive = t
+		return nil
+	}
+}
+
+// WithAddrStore sets the server.AddrStore, e.g. to share the domains between several servers.
+func WithAddrStore(store AddressStore) Option {
+	return func(s *Server) error {
+		if store == nil {
+			return fmt.Errorf("%w: address store is nil", ErrInvalidConfig)
+		}
+		s.AddrStore = store
+		return nil
+	}
+}
+
+// WithHeartbeats sets server.HeartbeatInterval and server.MissedHeartbeats. Members which have not been heard of for
+// missed * interval are evicted. If missed is negative, no members are evicted. It must not be zero.
+func WithHeartbeats(interval time.Duration, missed int) Option {
+	return func(s *Server) error {
+		if interval <= 0 {
+			return fmt.Errorf("%w: heartbeat interval of %v is not positive", ErrInvalidConfig, interval)
+		}
+		if missed == 0 {
+			return fmt.Errorf("%w: zero missed heartbeats would evict all members", ErrInvalidConfig)
+		}
+		s.HeartbeatInterval = interval
+		s.MissedHeartbeats = missed
+		return nil
+	}
+}
+
+// WithWebhooks sets server.WebhookURLs and server.WebhookSecret. Failed deliveries are retried up to retries times
+// with exponential backoff starting at backoff.
+func WithWebhooks(urls []string, secret string, retries int, backoff time.Duration) Option {
+	return func(s *Server) error {
+		s.WebhookURLs = urls
+		s.WebhookSecret = secret
+		s.WebhookRetries = retries
+		s.WebhookBackoff = backoff
+		return s.validateWebhooks()
+	}
+}
+
+// WithWebSocket serves the WebSocket transport at addr, over HTTPS if tlsConfig is not nil.
+func WithWebSocket(addr string, tlsConfig *tls.Config) Option {
+	return func(s *Server) error {
+		s.WebSocketAddr = addr
+		s.WebSocketTLS = tlsConfig
+		return validateListener("websocket transport", addr, tlsConfig)
+	}
+}
+
+// WithBackend serves the backend API at addr, over HTTPS if tlsConfig is not nil. Requests must carry token as bearer
+// token.
+func WithBackend(addr string, tlsConfig *tls.Config, token string) Option {
+	return func(s *Server) error {
+		s.BackendAddr = addr
+		s.BackendTLS = tlsConfig
+		s.BackendToken = token
+		if token == "" {
+			return fmt.Errorf("%w: backend api needs a token", ErrInvalidConfig)
+		}
+		return validateListener("backend api", addr, tlsConfig)
+	}
+}
+
+// WithAdmin serves the admin API as well as the health, readiness and metrics endpoints at addr, over HTTPS if
+// tlsConfig is not nil. Requests to the admin API must carry token as bearer token. If token is empty, only the
+// public endpoints are served.
+func WithAdmin(addr string, tlsConfig *tls.Config, token string) Option {
+	return func(s *Server) error {
+		s.AdminAddr = addr
+		s.AdminTLS = tlsConfig
+		s.AdminToken = token
+		return validateListener("admin api", addr, tlsConfig)
+	}
+}
+
+// validate returns an error wrapping ErrInvalidConfig if the configuration of the server cannot work.
+func (s *Server) validate() error {
+	switch {
+	case s.AddrStore == nil:
+		return fmt.Errorf("%w: address store is nil", ErrInvalidConfig)
+	case s.HeartbeatInterval <= 0:
+		return fmt.Errorf("%w: heartbeat interval of %v is not positive", ErrInvalidConfig, s.HeartbeatInterval)
+	case s.MissedHeartbeats == 0:
+		return fmt.Errorf("%w: zero missed heartbeats would evict all members", ErrInvalidConfig)
+	case 0 <= s.keepAlive && s.keepAlive < time.Second:
+		return fmt.Errorf("%w: keep alive of %v is less than 1s", ErrInvalidConfig, s.keepAlive)
+	case s.MaxPacketSize <= 0:
+		return fmt.Errorf("%w: max packet size of %d is not positive", ErrInvalidConfig, s.MaxPacketSize)
+	case s.MaxMetadataSize < 0 || s.MaxMetadataSize > s.MaxPacketSize:
+		return fmt.Errorf("%w: max metadata size of %d does not fit into max packet size of %d", ErrInvalidConfig, s.MaxMetadataSize, s.MaxPacketSize)
+	case s.MaxSignalSize < 0 || s.MaxSignalSize > s.MaxPacketSize:
+		return fmt.Errorf("%w: max signal size of %d does not fit into max packet size of %d", ErrInvalidConfig, s.MaxSignalSize, s.MaxPacketSize)
+	case s.RateBurst < 0 || s.SignalBurst < 0:
+		return fmt.Errorf("%w: burst is negative", ErrInvalidConfig)
+	case s.BackendAddr != "" && s.BackendToken == "":
+		return fmt.Errorf("%w: backend api needs a token", ErrInvalidConfig)
+	}
+
+	if tenants, ok := s.Tenants.(Tenants); ok {
+		names := make(map[string]struct{}, len(tenants))
+		for _, t := range tenants {
+			if t.Name == "" || strings.Contains(t.Name, "/") {
+				return fmt.Errorf("%w: tenant name %q is empty or contains '/'", ErrInvalidConfig, t.Name)
+			}
+			if _, ok := names[t.Name]; ok {
+				return fmt.Errorf("%w: tenant name %q is not unique", ErrInvalidConfig, t.Name)
+			}
+			names[t.Name] = struct{}{}
+		}
+	}
+	if err := s.validateWebhooks(); err != nil {
+		return err
+	}
+	if err := validateListener("websocket transport", s.WebSocketAddr, s.WebSocketTLS); err != nil {
+		return err
+	}
+	if err := validateListener("backend api", s.BackendAddr, s.BackendTLS); err != nil {
+		return err
+	}
+	return validateListener("admin api", s.AdminAddr, s.AdminTLS)
+}
+
+func (s *Server) validateWebhooks() error {
+	if len(s.WebhookURLs) == 0 {
+		return nil
+	}
+	if s.WebhookSecret == "" {
+		return fmt.Errorf("%w: webhooks need a secret to be signed with", ErrInvalidConfig)
+	}
+	if s.WebhookRetries < 0 {
+		return fmt.Errorf("%w: webhook retries of %d are negative", ErrInvalidConfig, s.WebhookRetries)
+	}
+	if s.WebhookRetries > 0 && s.WebhookBackoff <= 0 {
+		return fmt.Errorf("%w: webhook backoff of %v is not positive", ErrInvalidConfig, s.WebhookBackoff)
+	}
+	for _, u := range s.WebhookURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%w: webhook url %q is not an absolute http(s) url", ErrInvalidConfig, u)
+		}
+	}
+	return nil
+}
+
+// validateListener checks the TLS config of the listener called name at addr, which is disabled if addr is empty.
+func validateListener(name, addr string, tlsConfig *tls.Config) error {
+	if addr == "" || tlsConfig == nil {
+		return nil
+	}
+	if len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil && tlsConfig.GetConfigForClient == nil {
+		return fmt.Errorf("%w: tls config of %s has no certificate", ErrInvalidConfig, name)
+	}
+	return nil
+}
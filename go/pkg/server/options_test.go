@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/stdr"
+)
+
+func TestNew_Options(t *testing.T) {
+	store := newDomainAddrMap()
+	logger := stdr.New(nil).WithName("test")
+
+	s, err := New("127.0.0.1:0", WithKeepAlive(5*time.Second), WithAddrStore(store), WithLogger(logger),
+		WithHeartbeats(time.Second, 5), WithAdmin("127.0.0.1:0", nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if s.KeepAlive() != 5*time.Second {
+		t.Errorf("got keep alive %v\n want %v", s.KeepAlive(), 5*time.Second)
+	}
+	if s.AddrStore != store {
+		t.Errorf("got store %v\n want %v", s.AddrStore, store)
+	}
+	if s.Logger() != logger {
+		t.Errorf("got logger %v\n want %v", s.Logger(), logger)
+	}
+	if s.HeartbeatInterval != time.Second || s.MissedHeartbeats != 5 || s.AdminAddr != "127.0.0.1:0" {
+		t.Errorf("got heartbeats %v, %d and admin addr %q", s.HeartbeatInterval, s.MissedHeartbeats, s.AdminAddr)
+	}
+}
+
+func TestNew_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{"logger without sink", WithLogger(logr.Logger{})},
+		{"keep alive below 1s", WithKeepAlive(time.Millisecond)},
+		{"nil store", WithAddrStore(nil)},
+		{"heartbeat interval 0", WithHeartbeats(0, 3)},
+		{"missed heartbeats 0", WithHeartbeats(time.Second, 0)},
+		{"missed heartbeats field 0", func(s *Server) error { s.MissedHeartbeats = 0; return nil }},
+		{"webhook without secret", WithWebhooks([]string{"https://example.com/hooks"}, "", 5, time.Second)},
+		{"relative webhook url", WithWebhooks([]string{"/hooks"}, "secret", 5, time.Second)},
+		{"webhook backoff 0", WithWebhooks([]string{"https://example.com/hooks"}, "secret", 5, 0)},
+		{"backend without token", WithBackend("127.0.0.1:0", nil, "")},
+		{"tls without certificate", WithWebSocket("127.0.0.1:0", &tls.Config{})},
+		{"invalid field", func(s *Server) error { s.MaxMetadataSize = s.MaxPacketSize + 1; return nil }},
+		{"tenant name with slash", func(s *Server) error { s.Tenants = Tenants{"key": {Name: "a/b"}}; return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New("127.0.0.1:0", tt.opt)
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("got %v\n want %v", err, ErrInvalidConfig)
+			}
+			if s != nil {
+				t.Errorf("got server %v\n want nil", s)
+			}
+		})
+	}
+}
+
+func TestServer_Setters(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.SetKeepAlive(time.Minute)
+	if s.KeepAlive() != time.Minute {
+		t.Errorf("got keep alive %v\n want %v", s.KeepAlive(), time.Minute)
+	}
+	logger := stdr.New(nil).WithName("test")
+	s.SetLogger(logger)
+	if s.Logger() != logger {
+		t.Errorf("got logger %v\n want %v", s.Logger(), logger)
+	}
+}
+
+func TestServer_ListenAndServe_InvalidConfig(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.HeartbeatInterval = 0
+	if err := s.ListenAndServe(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("got %v\n want %v", err, ErrInvalidConfig)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// Topology restricts the roles the members of a provisioned domain register with.
+type Topology string
+
+const (
+	// TopologyAny admits mesh and star domains alike.
+	TopologyAny Topology = ""
+	// TopologyMesh only admits members without role.
+	TopologyMesh Topology = "mesh"
+	// TopologyStar only admits a host and guests.
+	TopologyStar Topology = "star"
+)
+
+// Provision is a domain created ahead of time by the backend, e.g. by a matchmaker which knows who will meet.
+// Registrations with the domain have to match the provision until it expires.
+type Provision struct {
+	// Domain is the domain id. If the server has tenants, it is the id within the namespace of the tenant.
+	Domain string `json:"domain"`
+	// Size is the expected number of members. Registrations declaring another size are rejected. Zero means the
+	// size is declared by the members as usual.
+	Size int `json:"size,omitempty"`
+	// Members are the client IDs (UUIDs) allowed to register. If it is empty, all clients are allowed. Otherwise, the
+	// clients must register with a join token bound to their client ID, as client IDs are no secret.
+	Members []string `json:"members,omitempty"`
+	// Topology restricts the roles of the members.
+	Topology Topology `json:"topology,omitempty"`
+	// Expires is the time the provision ends. Afterwards, registrations are treated like the ones of domains which
+	// have not been provisioned. Members which are already registered stay until they leave or are evicted.
+	Expires time.Time `json:"expires"`
+}
+
+// admits returns an error if m, registering with opts, must not register with the domain provisioned by p.
+func (p Provision) admits(m Member, opts ProcessOptions) error {
+	// the IDs of members are visible to their peers, hence anyone could claim a provisioned one
+	if len(p.Members) > 0 && !opts.VerifiedID {
+		return fmt.Errorf("%w: provisioned members must register with a join token bound to their client id", ErrUnauthorized)
+	}
+	if len(p.Members) > 0 && !containsString(p.Members, m.ID) {
+		return fmt.Errorf("%w: client is not a provisioned member of the domain", ErrUnauthorized)
+	}
+	if size := opts.Size; p.Size > 0 && size > 0 && size != p.Size {
+		return fmt.Errorf("%w: domain is provisioned for %d members", ErrSizeMismatch, p.Size)
+	}
+	if p.Topology == TopologyMesh && m.Role != protocol.RoleNone {
+		return fmt.Errorf("%w: role %s in mesh domain", ErrRoleConflict, m.Role)
+	}
+	if p.Topology == TopologyStar && m.Role == protocol.RoleNone {
+		return fmt.Errorf("%w: no role in star domain", ErrRoleConflict)
+	}
+	return nil
+}
+
+// provisions holds the provisions of domains by their key in the server.AddrStore. Expired provisions are removed
+// lazily and by expire.
+type provisions struct {
+	mutex sync.Mutex
+	m     map[string]Provision
+}
+
+func newProvisions() *provisions {
+	return &provisions{m: make(map[string]Provision)}
+}
+
+// put provisions the domain with key, replacing its previous provision.
+func (p *provisions) put(key string, provision Provision) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.m[key] = provision
+}
+
+// get returns the provision of the domain with key unless it has expired by now.
+func (p *provisions) get(key string, now time.Time) (Provision, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	provision, ok := p.m[key]
+	if ok && !now.Before(provision.Expires) {
+		delete(p.m, key)
+		return Provision{}, false
+	}
+	return provision, ok
+}
+
+// remove removes the provision of the domain with key and reports whether there was one.
+func (p *provisions) remove(key string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, ok := p.m[key]
+	delete(p.m, key)
+	return ok
+}
+
+// expire removes the provisions which have expired by now.
+func (p *provisions) expire(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for key, provision := range p.m {
+		if !now.Before(provision.Expires) {
+			delete(p.m, key)
+		}
+	}
+}
+
+// applyProvision checks the registration of m with the domain with key against its provision and applies the
+// expected size of the provision to opts. If the domain has not been provisioned, ErrNotProvisioned is returned if
+// server.RequireProvisioning is set.
+func (s *Server) applyProvision(key string, m Member, opts *ProcessOptions) error {
+	provision, ok := s.provisions.get(key, time.Now())
+	if !ok {
+		if s.RequireProvisioning {
+			return ErrNotProvisioned
+		}
+		return nil
+	}
+
+	if err := provision.admits(m, *opts); err != nil {
+		return err
+	}
+	if opts.Size == 0 {
+		opts.Size = provision.Size
+	}
+	return nil
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+func TestProvision_Admits(t *testing.T) {
+	p := Provision{Size: 2, Members: []string{"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}, Topology: TopologyStar}
+
+	tt := []struct {
+		name string
+		m    Member
+		opts ProcessOptions
+		want error
+	}{
+		{name: "provisioned member", m: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Role: protocol.RoleHost}, opts: ProcessOptions{VerifiedID: true}},
+		{name: "declared size", m: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Role: protocol.RoleHost}, opts: ProcessOptions{Size: 2, VerifiedID: true}},
+		{name: "unverified id", m: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Role: protocol.RoleHost}, want: ErrUnauthorized},
+		{name: "other member", m: Member{ID: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Role: protocol.RoleHost}, opts: ProcessOptions{VerifiedID: true}, want: ErrUnauthorized},
+		{name: "member without id", m: Member{Role: protocol.RoleHost}, want: ErrUnauthorized},
+		{name: "other size", m: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Role: protocol.RoleHost}, opts: ProcessOptions{Size: 3, VerifiedID: true}, want: ErrSizeMismatch},
+		{name: "no role", m: Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"}, opts: ProcessOptions{VerifiedID: true}, want: ErrRoleConflict},
+	}
+
+	for _, tc := range tt {
+		if err := p.admits(tc.m, tc.opts); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v\n want %v", tc.name, err, tc.want)
+		}
+	}
+
+	if err := (Provision{Topology: TopologyMesh}).admits(Member{Role: protocol.RoleGuest}, ProcessOptions{}); !errors.Is(err, ErrRoleConflict) {
+		t.Errorf("got %v\n want %v for role in mesh domain", err, ErrRoleConflict)
+	}
+}
+
+func TestProvisions_Get(t *testing.T) {
+	p := newProvisions()
+	now := time.Now()
+	p.put("a", Provision{Domain: "a", Expires: now.Add(time.Minute)})
+	p.put("b", Provision{Domain: "b", Expires: now.Add(time.Hour)})
+
+	if got, ok := p.get("a", now); !ok || got.Domain != "a" {
+		t.Errorf("got %v, %v\n want %v, %v", got.Domain, ok, "a", true)
+	}
+	if _, ok := p.get("a", now.Add(time.Minute)); ok {
+		t.Errorf("got %v\n want %v after expiry", ok, false)
+	}
+
+	p.expire(now.Add(2 * time.Hour))
+	if _, ok := p.get("b", now); ok {
+		t.Errorf("got %v\n want %v after expire", ok, false)
+	}
+	if p.remove("b") {
+		t.Errorf("got %v\n want %v for removed provision", true, false)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket rate limiter per key.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// answered is set once a denied packet has been answered and reset by the next allowed packet.
+	answered bool
+}
+
+// pruneInterval is the interval after which buckets of idle keys are dropped.
+const pruneInterval = time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+// allow reports whether key may send another packet at now, given a sustained rate in packets per second and a
+// burst. A non-positive rate allows everything.
+func (r *rateLimiter) allow(key string, rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.prune(now)
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		r.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	b.answered = false
+
+	return true
+}
+
+// answer reports whether a packet of key denied by allow may be answered, which is only the case for the first denied
+// packet since the last allowed one. This keeps the answers to key below its rate, so a sender spoofing the address
+// of a victim cannot use the server to amplify its traffic.
+func (r *rateLimiter) answer(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.buckets[key]
+	if !ok || b.answered {
+		return false
+	}
+	b.answered = true
+
+	return true
+}
+
+// prune drops the buckets which have not been used for pruneInterval. They would be full again anyway.
+func (r *rateLimiter) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < pruneInterval {
+		return
+	}
+	r.lastPrune = now
+
+	for key, b := range r.buckets {
+		if now.Sub(b.last) >= pruneInterval {
+			delete(r.buckets, key)
+		}
+	}
+}
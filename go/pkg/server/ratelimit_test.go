@@ -0,0 +1,55 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !r.allow("143.92.93.227:33333", 1, 3, now) {
+			t.Fatalf("got %v\n want %v for packet %d of burst", false, true, i)
+		}
+	}
+	if r.allow("143.92.93.227:33333", 1, 3, now) {
+		t.Errorf("got %v\n want %v after burst", true, false)
+	}
+	if !r.allow("47.123.241.125:45433", 1, 3, now) {
+		t.Errorf("got %v\n want %v for other address", false, true)
+	}
+	if !r.allow("143.92.93.227:33333", 1, 3, now.Add(time.Second)) {
+		t.Errorf("got %v\n want %v after refill", false, true)
+	}
+	if !r.allow("143.92.93.227:33333", 0, 0, now) {
+		t.Errorf("got %v\n want %v with rate limiting disabled", false, true)
+	}
+}
+
+func TestRateLimiter_Answer(t *testing.T) {
+	r := newRateLimiter()
+	now := time.Now()
+
+	if r.answer("143.92.93.227:33333") {
+		t.Errorf("got %v\n want %v for unknown address", true, false)
+	}
+	r.allow("143.92.93.227:33333", 1, 1, now)
+	for i := 0; i < 3; i++ {
+		if r.allow("143.92.93.227:33333", 1, 1, now) {
+			t.Fatalf("got %v\n want %v after burst", true, false)
+		}
+		if got := r.answer("143.92.93.227:33333"); got != (i == 0) {
+			t.Errorf("got %v\n want %v for denied packet %d", got, i == 0, i)
+		}
+	}
+
+	if !r.allow("143.92.93.227:33333", 1, 1, now.Add(time.Second)) {
+		t.Fatalf("got %v\n want %v after refill", false, true)
+	}
+	r.allow("143.92.93.227:33333", 1, 1, now.Add(time.Second))
+	if !r.answer("143.92.93.227:33333") {
+		t.Errorf("got %v\n want %v for first denied packet after refill", false, true)
+	}
+}
@@ -1,112 +1,687 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"github.com/4kills/hole-punching/go/pkg/token"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/stdr"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"log"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type server struct {
+// Server is a rendezvous server, which hands the clients registering with the same domain each other's public
+// endpoints. Construct it with New.
+type Server struct {
 	// ListeningAddr is the addr (ip:port) this server listens to.
 	ListeningAddr string
 	// AddrStore temporarily stores the connecting addresses with the given domain. This can be overridden by your own implementation.
 	// E.g. to make it work in a load balanced environment.
 	AddrStore AddressStore
-	// DomainTimeout is the time after which an address associated to a domain is removed from the server.AddrStore.
-	// If DomainTimeout is negative, no addresses are removed.
-	DomainTimeout time.Duration
-	// MaxPacketSize defines the max length of the packet payload. As the UUID of the client (addr) is 16 bytes, MaxPacketSize - 16 bytes are left for the domain ID.
-	// If a packet's payload length exceeds MaxPacketSize, the packet is dropped and not processed.
+	// HeartbeatInterval is the interval in which registered clients are expected to send heartbeats.
+	HeartbeatInterval time.Duration
+	// MissedHeartbeats is the number of heartbeats a member of a domain may miss in a row. Members which have not been
+	// heard of for MissedHeartbeats * HeartbeatInterval are evicted from the server.AddrStore.
+	// If MissedHeartbeats is negative, no members are evicted. It must not be zero.
+	MissedHeartbeats int
+	// MaxPacketSize defines the max length of the packet payload. It is advertised to clients, which refuse domain IDs
+	// too long for their registration to fit.
+	// If a packet's payload length exceeds MaxPacketSize, the packet is not processed and answered with
+	// protocol.CodePacketTooLarge.
 	MaxPacketSize int
+	// RateLimit is the sustained number of packets per second accepted from a single address. Up to RateBurst packets
+	// are accepted at once. Packets exceeding the limit are not processed. Only the first of them after an accepted
+	// packet is answered with protocol.CodeRateLimited, so the answers stay below the limit as well.
+	// If RateLimit is not positive, packets are not rate limited.
+	RateLimit float64
+	RateBurst int
+	// MaxMetadataSize is the maximum size of the metadata a client may attach to its registration. Registrations with
+	// larger metadata are answered with protocol.CodeMetadataTooLarge. The metadata must fit into MaxPacketSize as well.
+	MaxMetadataSize int
+	// MaxSignalSize is the maximum payload size of a signal relayed between members. SignalRate and SignalBurst limit
+	// the signals relayed per second for a single address like RateLimit and RateBurst. Signals exceeding any of
+	// these limits are dropped. If SignalRate is not positive, signals are not rate limited apart from RateLimit.
+	MaxSignalSize int
+	SignalRate    float64
+	SignalBurst   int
+	// TokenVerifier verifies the join tokens of registrations. If it is nil, registrations do not need a token.
+	// Otherwise, registrations without a valid token for their domain are rejected with protocol.CodeUnauthorized.
+	// Legacy clients cannot send tokens and are rejected as well.
+	TokenVerifier token.Verifier
+	// Tenants resolves the API keys of clients to tenants, e.g. products sharing the server. If it is nil, all
+	// domains share a single namespace. Otherwise, every message referring to a domain must carry the API key of a
+	// tenant and is rejected with protocol.CodeUnauthorized if it does not. The quotas of the tenant are enforced
+	// before the registration reaches the AddrStore. Legacy clients cannot send API keys and are rejected as well.
+	Tenants TenantStore
+	// RequireProvisioning only admits registrations with domains provisioned through the backend API, see
+	// server.BackendHandler. Other registrations are rejected with protocol.CodeNotProvisioned.
+	RequireProvisioning bool
+	// BackendAddr is the addr (ip:port) the backend API to provision, inspect and delete domains is served at (path
+	// BackendPath). If it is empty, the API is only available through server.BackendHandler. If BackendTLS is set, it
+	// is served over HTTPS. Requests must carry BackendToken as bearer token. If BackendToken is empty, all requests
+	// are rejected.
+	BackendAddr  string
+	BackendTLS   *tls.Config
+	BackendToken string
+	// AdminAddr is the addr (ip:port) the admin API as well as the health and readiness endpoints are served at, see
+	// server.AdminHandler. If it is empty, they are only available through server.AdminHandler. If AdminTLS is set,
+	// they are served over HTTPS. Requests to the admin API must carry AdminToken as bearer token. If AdminToken is
+	// empty, all of them are rejected.
+	AdminAddr  string
+	AdminTLS   *tls.Config
+	AdminToken string
+	// AcceptLegacy enables the compatibility mode for clients speaking the unframed text protocol, i.e. sending the
+	// raw domain ID and expecting a comma-joined list of addresses.
+	AcceptLegacy bool
+	// WebSocketAddr is the addr (ip:port) the WebSocket transport for clients whose UDP registration is blocked is
+	// served at (path WebSocketPath). If it is empty, the transport is only available through
+	// server.WebSocketHandler. If WebSocketTLS is set, it is served over HTTPS.
+	WebSocketAddr string
+	WebSocketTLS  *tls.Config
+	// WebhookURLs are the URLs the lifecycle events of domains are POSTed to as JSON, see Event. The requests are
+	// signed with WebhookSecret, which must not be empty, see VerifyWebhook. Failed deliveries are retried up to
+	// WebhookRetries times, waiting WebhookBackoff before the first retry and twice as long before each further one.
+	// Events are delivered in the background, not necessarily in order, and dropped if too many are pending.
+	WebhookURLs    []string
+	WebhookSecret  string
+	WebhookRetries int
+	WebhookBackoff time.Duration
+	// TracerProvider creates the OpenTelemetry spans of registrations. They continue the trace the client sends along
+	// with its registration. If it is nil, the global provider is used, which does not record anything unless set with
+	// otel.SetTracerProvider.
+	TracerProvider trace.TracerProvider
 
 	keepAlive time.Duration
 	log    logr.Logger
   	socket *net.UDPConn
+	// legacyAddrs holds the addresses which registered using the legacy text protocol.
+	legacyAddrs *sync.Map
+	limiter     *rateLimiter
+	tenantDomains *tenantDomains
+	provisions  *provisions
+	webhooks    chan Event
+	metrics     *metrics
+	// serving is 1 once ListenAndServe handles packets.
+	serving *int32
+	// wsConns maps the UDP endpoints of clients connected through WebSocket to their *wsSession.
+	wsConns *sync.Map
+	// wsProbes maps the nonces of pending UDP probes to their *wsSession.
+	wsProbes *sync.Map
+	lifecycle *lifecycle
 }
 
 // New constructs a default server listening to listeningAddr with a Go map as server.AddrStore implementation and
-// the Go standard log package as logr.Logger.
-// It is strongly recommended reviewing the server.DomainTimeout field.
-func New(listeningAddr string) (server, error) {
-	s := server{
+// the Go standard log package as logr.Logger. The defaults are overridden by opts, which are applied in order.
+// If an option or the resulting configuration is invalid, an error wrapping ErrInvalidConfig is returned.
+// It is strongly recommended reviewing the server.HeartbeatInterval and server.MissedHeartbeats fields.
+func New(listeningAddr string, opts ...Option) (*Server, error) {
+	s := &Server{
 		ListeningAddr: listeningAddr,
-		DomainTimeout: 40 * time.Second,
+		HeartbeatInterval: 10 * time.Second,
+		MissedHeartbeats: 3,
 		keepAlive: 10 * time.Second,
 		MaxPacketSize: 1024,
-		AddrStore:     domainAddrMap{make(map[string][]string), &sync.Mutex{}, make([]string, 1024)},
+		RateLimit: 20,
+		RateBurst: 40,
+		MaxMetadataSize: 256,
+		MaxSignalSize: 512,
+		SignalRate: 5,
+		SignalBurst: 10,
+		AcceptLegacy: true,
+		WebhookRetries: 5,
+		WebhookBackoff: time.Second,
+		AddrStore:     newDomainAddrMap(),
+
+		legacyAddrs: &sync.Map{},
+		limiter:     newRateLimiter(),
+		tenantDomains: newTenantDomains(),
+		provisions:  newProvisions(),
+		webhooks:    make(chan Event, webhookQueueSize),
+		serving:     new(int32),
+		metrics:     newMetrics(),
+		wsConns:     &sync.Map{},
+		wsProbes:    &sync.Map{},
+		lifecycle:   newLifecycle(),
 
 		log: stdr.New(nil),
 	}
 
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveUDPAddr(udpNetworkName, listeningAddr)
 	if err != nil {
-		return s, err
+		return nil, err
 	}
 
 	s.socket, err = net.ListenUDP(udpNetworkName, addr)
 	if err != nil {
-		return s, err
+		return nil, err
 	}
 
-	return s, err
+	return s, nil
 }
 
 // ListenAndServe starts the server, listening to server.ListeningAddr and handling inbound packets. Once this is called,
 // changes on s are not guaranteed to have an effect.
-func (s server) ListenAndServe() {
+// ListenAndServe blocks until the server is stopped by server.Shutdown or server.Close and then returns
+// ErrServerClosed. Otherwise, it returns the error which stopped it. As the exported fields may have been changed
+// since New, the configuration is validated again first.
+func (s *Server) ListenAndServe() error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if !s.lifecycle.acquire() {
+		return ErrServerClosed
+	}
+	defer s.lifecycle.release()
+
 	s.log.V(1).Info("server started")
 	buffer := make([]byte, 2 * s.MaxPacketSize)
 
-	go s.sendKeepAlives()
+	s.lifecycle.goroutine(s.sendKeepAlives)
+	s.lifecycle.goroutine(s.evictMembers)
+	if s.WebSocketAddr != "" {
+		s.lifecycle.goroutine(s.listenWebSocket)
+	}
+	if s.BackendAddr != "" {
+		s.lifecycle.goroutine(s.listenBackend)
+	}
+	if s.AdminAddr != "" {
+		s.lifecycle.goroutine(s.listenAdmin)
+	}
+	if len(s.WebhookURLs) > 0 {
+		for i := 0; i < webhookWorkers; i++ {
+			s.lifecycle.goroutine(s.deliverWebhooks)
+		}
+	}
 
+	// the collector reads the AddrStore, which may be replaced until now
+	if err := s.metrics.registry.Register(newDomainCollector(s)); err != nil {
+		s.log.V(1).Info("could not register domain metrics", "error", err.Error())
+	}
+
+	atomic.StoreInt32(s.serving, 1)
 	for {
 		n, addr, err := s.socket.ReadFromUDP(buffer)
+		if s.lifecycle.isClosed() {
+			s.log.V(1).Info("server stopped")
+			return ErrServerClosed
+		}
+		if errors.Is(err, net.ErrClosed) {
+			atomic.StoreInt32(s.serving, 0)
+			return err
+		}
 		if err != nil {
-			s.log.Error(err, "read from udp with remote address: rejecting address", logKeyAddr, addr.String())
+			s.log.Error(err, "could not read from udp")
+			continue
+		}
+		s.metrics.packetsReceived.Inc()
+		legacy := !protocol.IsFramed(buffer[:n])
+		if !s.limiter.allow(addr.String(), s.RateLimit, s.RateBurst, time.Now()) {
+			s.metrics.packetsDropped.WithLabelValues(dropRateLimited).Inc()
+			s.log.V(1).Info("remote address exceeded rate limit: dropping packet", logKeyAddr, addr.String())
+			if s.limiter.answer(addr.String()) {
+				s.reject(addr, legacy, protocol.CodeRateLimited, errRateLimited)
+			}
 			continue
 		}
 		if n > s.MaxPacketSize {
+			s.metrics.packetsDropped.WithLabelValues(dropOversized).Inc()
 			s.log.V(1).Info( "package payload by remote address with messageLength bytes exceeded maxPacketSize: rejecting address.",
 				logKeyAddr, addr.String(), "messageLength", n, "maxPacketSize", s.MaxPacketSize)
+			s.reject(addr, legacy, protocol.CodePacketTooLarge, fmt.Errorf("%w: %d bytes exceed %d bytes", errPacketTooLarge, n, s.MaxPacketSize))
 			continue
 		}
 
-		id := string(buffer[:n])
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
 
-		go s.handleConnection(id, addr)
+		s.lifecycle.goroutine(func() { s.handlePacket(packet, addr) })
 	}
 }
 
-func (s server) handleConnection(id string, addr *net.UDPAddr) {
-	remoteAddrs, err := s.AddrStore.ProcessAddress(id, addr.String(), s.DomainTimeout)
+// handlePacket decodes packet and dispatches it. Unframed packets are treated as legacy registrations if
+// server.AcceptLegacy is set.
+func (s *Server) handlePacket(packet []byte, addr *net.UDPAddr) {
+	if !protocol.IsFramed(packet) {
+		if !s.AcceptLegacy {
+			s.metrics.packetsDropped.WithLabelValues(dropLegacyDisabled).Inc()
+			s.log.V(1).Info("received unframed packet with legacy mode disabled: rejecting address", logKeyAddr, addr.String())
+			return
+		}
+		s.legacyAddrs.Store(addr.String(), struct{}{})
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: packet}, addr, true)
+		return
+	}
+
+	msg, err := protocol.Unmarshal(packet)
+	if err != nil {
+		s.metrics.packetsDropped.WithLabelValues(dropMalformed).Inc()
+		s.log.V(1).Info("could not decode message: rejecting address", logKeyAddr, addr.String(), "error", err.Error())
+		code := protocol.CodeMalformed
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			code = protocol.CodeUnsupportedVersion
+		}
+		s.reject(addr, false, code, err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.TypeRegister:
+		s.handleConnection(msg, addr, false)
+	case protocol.TypeLeave, protocol.TypeDone:
+		s.handleLeave(msg, addr)
+	case protocol.TypeHeartbeat:
+		s.handleHeartbeat(msg, addr)
+	case protocol.TypeQuery:
+		s.handleQuery(msg, addr)
+	case protocol.TypeSignal:
+		s.handleSignal(msg, addr)
+	case protocol.TypeProbe:
+		s.handleProbe(msg, addr)
+	case protocol.TypeKeepAlive:
+	default:
+		s.log.V(1).Info("received message of unexpected type: rejecting address", logKeyAddr, addr.String(), "type", msg.Type.String())
+	}
+}
+
+func (s *Server) handleConnection(msg protocol.Message, addr *net.UDPAddr, legacy bool) {
+	member := memberOf(msg, addr)
+
+	_, span := s.tracer().Start(remoteContext(msg.TraceParent), "server.handleConnection", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrDomain.String(string(msg.Domain)), attrPeer.String(addr.String())))
+	defer span.End()
+	reject := func(code protocol.ErrorCode, err error) {
+		span.SetAttributes(attrOutcome.String("rejected"), attrCode.String(code.String()))
+		span.SetStatus(codes.Error, err.Error())
+		s.reject(addr, legacy, code, err)
+	}
+
+	tenant, domain, ok := s.admit(msg, addr, legacy)
+	if !ok {
+		span.SetAttributes(attrOutcome.String("rejected"))
+		span.SetStatus(codes.Error, "tenant not admitted")
+		return
+	}
+	span.SetAttributes(attrTenant.String(tenant.Name))
+
+	if len(msg.Metadata) > s.MaxMetadataSize {
+		s.log.V(1).Info("metadata exceeded maxMetadataSize: rejecting address", logKeyAddr, addr.String(), "maxMetadataSize", s.MaxMetadataSize)
+		reject(protocol.CodeMetadataTooLarge, fmt.Errorf("%w: %d bytes exceed %d bytes", errMetadataTooLarge, len(msg.Metadata), s.MaxMetadataSize))
+		return
+	}
+
+	opts := ProcessOptions{Size: msg.Size}
+
+	if s.TokenVerifier != nil {
+		claims, err := s.authorize(msg, legacy)
+		if err != nil {
+			s.log.V(1).Info("could not authorize registration: rejecting address", logKeyAddr, addr.String(), "error", err.Error())
+			reject(protocol.CodeUnauthorized, err)
+			return
+		}
+		opts.MaxMembers = claims.MaxMembers
+		// authorize has checked that a token bound to a client id was issued for the client id of msg
+		opts.VerifiedID = claims.ClientID != ""
+	}
+
+	if tenant.MaxMembers > 0 && (opts.MaxMembers == 0 || tenant.MaxMembers < opts.MaxMembers) {
+		opts.MaxMembers = tenant.MaxMembers
+	}
+	if err := s.applyProvision(domain, member, &opts); err != nil {
+		code, _ := registrationErrorCode(err)
+		s.log.V(1).Info("provision does not admit address: rejecting address", logKeyAddr, addr.String(), "reason", err.Error())
+		reject(code, err)
+		return
+	}
+	reserved := false
+	if s.Tenants != nil {
+		var err error
+		if reserved, err = s.tenantDomains.reserve(tenant, domain); err != nil {
+			s.log.V(1).Info("tenant exceeded its quota: rejecting address", logKeyAddr, addr.String(), logKeyTenant, tenant.Name, "reason", err.Error())
+			reject(protocol.CodeQuotaExceeded, err)
+			return
+		}
+	}
+
+	start := time.Now()
+	reg, err := s.AddrStore.ProcessAddress(domain, member, opts)
+	s.metrics.processDuration.WithLabelValues(tenant.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.processErrors.WithLabelValues(tenant.Name).Inc()
+	}
+	if err != nil && reserved {
+		s.releaseDomain(domain)
+	}
+	if code, ok := registrationErrorCode(err); ok {
+		s.log.V(1).Info("domain does not admit address: rejecting address", logKeyAddr, addr.String(), "reason", err.Error())
+		reject(code, err)
+		return
+	}
 	if err != nil {
 		s.log.Error(err, "could not store address: rejecting address", logKeyAddr, addr.String())
+		reject(protocol.CodeStoreFailure, errStoreFailure)
 		return
 	}
 
-	payload := strings.Join(remoteAddrs, ",")
-	_, err = s.socket.WriteToUDP([]byte(payload), addr)
+	member, members := reg.Member, reg.Others
+	if reg.Created {
+		s.emit(Event{Type: EventDomainCreated, Domain: domain})
+	}
+	if reg.Joined {
+		s.emitMember(EventMemberJoined, domain, member, len(members)+1)
+	}
+
+	peers := s.toPeers(members)
+	visible := visibleTo(member.Role, peers)
+	span.SetAttributes(attrOutcome.String("registered"), attrIndex.Int(member.Index), attrPeers.Int(len(peers)))
+
+	if legacy {
+		s.write(addr, protocol.EncodeLegacyPeers(visible))
+	} else {
+		params := s.params()
+		s.send(addr, protocol.Message{Type: protocol.TypePeers, Peers: visible, Index: member.Index, Params: &params})
+	}
+
+	peer := protocol.Peer{ID: msg.ClientID, Addr: addr, Index: member.Index, Role: member.Role, Metadata: member.Metadata}
+	// the size may have been declared by other members, e.g. guests of star domains do not declare it
+	if reg.Size > 0 && len(members)+1 == reg.Size {
+		if reg.Completed {
+			s.emit(Event{Type: EventDomainReady, Domain: domain, Members: reg.Size})
+			s.observeCompletion(tenant.Name, domain)
+		}
+		s.announceReady(insertPeer(peers, peer))
+		return
+	}
+	// repeated registrations, e.g. the periodic ones of waiting clients, are answered above but not pushed to the
+	// peers unless the member changed
+	if reg.Joined || reg.Changed {
+		s.notifyPeers(peers, peer)
+	}
+}
+
+// registrationErrorCode returns the error code for errors of AddressStore.ProcessAddress and server.applyProvision
+// which are caused by the registration rather than by the store.
+func registrationErrorCode(err error) (protocol.ErrorCode, bool) {
+	switch {
+	case errors.Is(err, ErrDomainFull):
+		return protocol.CodeDomainFull, true
+	case errors.Is(err, ErrDomainSealed):
+		return protocol.CodeDomainSealed, true
+	case errors.Is(err, ErrSizeMismatch):
+		return protocol.CodeSizeMismatch, true
+	case errors.Is(err, ErrRoleConflict):
+		return protocol.CodeRoleConflict, true
+	case errors.Is(err, ErrUnauthorized):
+		return protocol.CodeUnauthorized, true
+	case errors.Is(err, ErrNotProvisioned):
+		return protocol.CodeNotProvisioned, true
+	case errors.Is(err, ErrIDInUse):
+		return protocol.CodeIDInUse, true
+	default:
+		return protocol.CodeUnknown, false
+	}
+}
+
+// handleLeave removes the sender of the leave or done message msg from its domain. Only addr itself can leave, so a
+// client knowing the ID of another one cannot remove it. The remaining members are only notified of members which
+// left, as members which are done are still connected to them.
+func (s *Server) handleLeave(msg protocol.Message, addr *net.UDPAddr) {
+	member := memberOf(msg, addr)
+
+	_, domain, ok := s.admit(msg, addr, false)
+	if !ok {
+		return
+	}
+
+	remaining, err := s.AddrStore.RemoveAddress(domain, member)
+	if errors.Is(err, ErrUnknownMember) {
+		s.log.V(1).Info("received leave message of address which is not a member", logKeyAddr, addr.String())
+		return
+	}
+	if err != nil {
+		s.log.Error(err, "could not remove address", logKeyAddr, addr.String())
+		return
+	}
+
+	s.log.V(1).Info("address left its domain", logKeyAddr, addr.String(), logKeyID, member.ID)
+	s.emitMember(EventMemberLeft, domain, member, len(remaining))
+	if len(remaining) == 0 {
+		s.releaseDomain(domain)
+		s.emit(Event{Type: EventDomainDeleted, Domain: domain})
+	}
+	if msg.Type == protocol.TypeLeave {
+		s.notifyLeft(s.toPeers(remaining), s.toPeers([]Member{member}))
+	}
+}
+
+// handleHeartbeat records the presence of the sender of the heartbeat msg. Senders which are not a member of the
+// domain, e.g. because they have been evicted, are asked to register again.
+func (s *Server) handleHeartbeat(msg protocol.Message, addr *net.UDPAddr) {
+	_, domain, ok := s.admit(msg, addr, false)
+	if !ok {
+		return
+	}
+
+	err := s.AddrStore.Heartbeat(domain, memberOf(msg, addr))
+	if errors.Is(err, ErrUnknownMember) {
+		s.log.V(1).Info("received heartbeat of address which is not a member", logKeyAddr, addr.String())
+		s.reject(addr, false, protocol.CodeNotRegistered, err)
+		return
+	}
 	if err != nil {
-		s.log.Error(err, "writing to remote address ; socket listening on port", logKeyAddr, addr.String(), "port", s.socket.RemoteAddr().String())
+		s.log.Error(err, "could not record heartbeat", logKeyAddr, addr.String())
+	}
+}
+
+// handleQuery answers the query msg with the state of its domain. The members are only revealed if the query
+// carries a token authorizing the domain.
+func (s *Server) handleQuery(msg protocol.Message, addr *net.UDPAddr) {
+	_, domain, ok := s.admit(msg, addr, false)
+	if !ok {
+		return
+	}
+
+	info, err := s.AddrStore.Describe(domain)
+	if err != nil {
+		s.log.Error(err, "could not describe domain", logKeyAddr, addr.String())
+		s.reject(addr, false, protocol.CodeStoreFailure, errStoreFailure)
+		return
+	}
+
+	reply := protocol.Message{
+		Type:   protocol.TypeDomainInfo,
+		Domain: msg.Domain,
+		Info:   &protocol.DomainInfo{Members: len(info.Members), Size: info.Size, Sealed: info.Sealed},
+	}
+	if !info.Created.IsZero() {
+		reply.Info.Age = time.Since(info.Created)
+	}
+
+	if msg.Token != "" && s.TokenVerifier != nil {
+		if _, err := s.authorize(msg, false); err != nil {
+			s.log.V(1).Info("could not authorize query: rejecting address", logKeyAddr, addr.String(), "error", err.Error())
+			s.reject(addr, false, protocol.CodeUnauthorized, err)
+			return
+		}
+		reply.Peers = s.toPeers(info.Members)
+	}
+
+	s.send(addr, reply)
+}
+
+// authorize verifies the join token of the registration or query msg and returns its claims.
+func (s *Server) authorize(msg protocol.Message, legacy bool) (token.Claims, error) {
+	if legacy {
+		return token.Claims{}, fmt.Errorf("%w: legacy registrations cannot carry a token", ErrUnauthorized)
+	}
+
+	claims, err := s.TokenVerifier.Verify(msg.Token)
+	if err != nil {
+		return claims, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	if claims.Domain != string(msg.Domain) {
+		return claims, fmt.Errorf("%w: token was issued for another domain", ErrUnauthorized)
+	}
+	if claims.ClientID != "" && claims.ClientID != msg.ClientID.String() {
+		return claims, fmt.Errorf("%w: token was issued for another client", ErrUnauthorized)
+	}
+
+	return claims, nil
+}
+
+// reject answers addr with an error message. Legacy clients cannot decode error messages and receive no answer.
+func (s *Server) reject(addr *net.UDPAddr, legacy bool, code protocol.ErrorCode, err error) {
+	if legacy {
+		return
+	}
+	params := s.params()
+	s.send(addr, protocol.Message{Type: protocol.TypeError, Code: code, Reason: err.Error(), Params: &params})
+}
+
+// params returns the session parameters advertised to clients.
+func (s *Server) params() protocol.Params {
+	p := protocol.Params{
+		HeartbeatInterval: s.HeartbeatInterval,
+		MaxPacketSize:     s.MaxPacketSize,
+	}
+	if s.keepAlive > 0 {
+		p.KeepAliveInterval = s.keepAlive
+	}
+	if s.MissedHeartbeats >= 0 {
+		p.MemberTTL = time.Duration(s.MissedHeartbeats) * s.HeartbeatInterval
+	}
+	if s.RateLimit > 0 {
+		p.RetryPeriod = time.Duration(float64(time.Second) / s.RateLimit)
+	}
+
+	return p
+}
+
+// memberOf returns the member sending msg from addr.
+func memberOf(msg protocol.Message, addr *net.UDPAddr) Member {
+	m := Member{Addr: addr.String(), Role: msg.Role, Metadata: msg.Metadata}
+	if !msg.ClientID.IsZero() {
+		m.ID = msg.ClientID.String()
+	}
+	// only the hash is stored, so the secret cannot be learned from the store
+	if len(msg.Secret) > 0 {
+		hash := sha256.Sum256(msg.Secret)
+		m.SecretHash = hash[:]
+	}
+
+	return m
+}
+
+// toPeers converts stored members to their wire representation. Members which cannot be converted are skipped.
+func (s *Server) toPeers(members []Member) []protocol.Peer {
+	peers := make([]protocol.Peer, 0, len(members))
+	for _, m := range members {
+		peer, err := toPeer(m)
+		if err != nil {
+			s.log.Error(err, "could not resolve stored member, skipping it", logKeyAddr, m.Addr, logKeyID, m.ID)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// toPeer converts a stored member to its wire representation.
+func toPeer(m Member) (protocol.Peer, error) {
+	var p protocol.Peer
+
+	addr, err := net.ResolveUDPAddr(udpNetworkName, m.Addr)
+	if err != nil {
+		return p, err
+	}
+	p.Addr = addr
+	p.Index = m.Index
+	p.Role = m.Role
+	p.Metadata = m.Metadata
+
+	if m.ID != "" {
+		p.ID, err = protocol.ParseUUID(m.ID)
+	}
+
+	return p, err
+}
+
+// insertPeer inserts p into peers ordered by index.
+func insertPeer(peers []protocol.Peer, p protocol.Peer) []protocol.Peer {
+	i := len(peers)
+	for i > 0 && peers[i-1].Index > p.Index {
+		i--
+	}
+
+	ret := make([]protocol.Peer, 0, len(peers)+1)
+	ret = append(ret, peers[:i]...)
+	ret = append(ret, p)
+	return append(ret, peers[i:]...)
+}
+
+// send encodes msg and writes it to addr. The reflexive address of msg is set to addr.
+func (s *Server) send(addr *net.UDPAddr, msg protocol.Message) {
+	msg.Reflexive = addr
+	payload, err := protocol.Marshal(msg)
+	if err != nil {
+		s.log.Error(err, "could not encode message", logKeyAddr, addr.String(), "type", msg.Type.String())
+		return
+	}
+
+	s.write(addr, payload)
+}
+
+// write sends payload to addr, over WebSocket if the client at addr is connected through it.
+func (s *Server) write(addr *net.UDPAddr, payload []byte) {
+	if v, ok := s.wsConns.Load(addr.String()); ok {
+		if err := v.(*wsSession).write(payload); err != nil {
+			s.log.Error(err, "writing to websocket of remote address", logKeyAddr, addr.String())
+			return
+		}
+		s.log.V(1).Info("wrote package to websocket of address with payload", logKeyAddr, addr.String(), "payload", payload)
+		return
+	}
+
+	_, err := s.socket.WriteToUDP(payload, addr)
+	if err != nil {
+		s.log.Error(err, "writing to remote address ; socket listening on port", logKeyAddr, addr.String(), "port", s.socket.LocalAddr().String())
 		return
 	}
 
 	s.log.V(1).Info("wrote package to address with payload", logKeyAddr, addr.String(), "payload", payload)
 }
 
-func (s server) sendKeepAlives() {
+func (s *Server) sendKeepAlives() {
 	if s.keepAlive < 0 {
 		return
 	}
 
+	keepAlive, err := protocol.Marshal(protocol.Message{Type: protocol.TypeKeepAlive})
+	if err != nil {
+		s.log.Error(err, "could not encode keep alive message")
+		return
+	}
+
 	// TODO: optimize this to not send all packets at once
-	for {
-		time.Sleep(s.keepAlive)
+	for s.lifecycle.sleep(s.keepAlive) {
 		s.log.V(1).Info("sending keep-alive packets")
 
 		addrs, err := s.AddrStore.FetchAllAddresses()
@@ -115,6 +690,8 @@ func (s server) sendKeepAlives() {
 			continue
 		}
 
+		s.pruneLegacyAddrs(addrs)
+
 		for _, addrStr := range addrs {
 			addr, err := net.ResolveUDPAddr(udpNetworkName, addrStr)
 			if err != nil {
@@ -122,31 +699,85 @@ func (s server) sendKeepAlives() {
 				continue
 			}
 
-			_, err = s.socket.WriteToUDP([]byte{}, addr)
+			payload := keepAlive
+			if _, ok := s.legacyAddrs.Load(addrStr); ok {
+				payload = []byte{} // legacy clients only ignore empty keep alive packets
+			}
+
+			_, err = s.socket.WriteToUDP(payload, addr)
 			if err != nil {
+				s.metrics.keepAlivesFailed.Inc()
 				s.log.Error(err, "could not write to udp while trying to send keep alive packet, skipping for now", logKeyAddr, addr)
 				continue
 			}
+			s.metrics.keepAlivesSent.Inc()
+		}
+	}
+}
+
+// pruneLegacyAddrs forgets legacy addresses which are no longer contained in the current addrs of the store.
+func (s *Server) pruneLegacyAddrs(addrs []string) {
+	current := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = struct{}{}
+	}
+
+	s.legacyAddrs.Range(func(key, _ interface{}) bool {
+		if _, ok := current[key.(string)]; !ok {
+			s.legacyAddrs.Delete(key)
+		}
+		return true
+	})
+}
+
+// evictMembers periodically evicts the members which have missed server.MissedHeartbeats heartbeats until the server
+// is shut down.
+func (s *Server) evictMembers() {
+	if s.MissedHeartbeats < 0 {
+		return
+	}
+
+	window := time.Duration(s.MissedHeartbeats) * s.HeartbeatInterval
+	for s.lifecycle.sleep(s.HeartbeatInterval) {
+		s.provisions.expire(time.Now())
+
+		evictions, err := s.AddrStore.Evict(time.Now().Add(-window))
+		if err != nil {
+			s.log.Error(err, "could not evict members")
+			continue
+		}
+
+		for _, e := range evictions {
+			for _, m := range e.Members {
+				s.log.V(1).Info("evicted member after missing heartbeats", logKeyAddr, m.Addr, logKeyID, m.ID)
+				s.emitMember(EventMemberExpired, e.Domain, m, len(e.Remaining))
+			}
+			s.notifyLeft(s.toPeers(e.Remaining), s.toPeers(e.Members))
+			if len(e.Remaining) == 0 {
+				s.releaseDomain(e.Domain)
+				s.emit(Event{Type: EventDomainDeleted, Domain: e.Domain})
+			}
 		}
 	}
 }
 
 // SetKeepAlive sets the time after which an address receives a keep alive packet in order to keep the NAT mapping intact.
-// If the value is negative, keep alive packets are disabled. t must not be greater than or equal 0 but be less than 1 s. If it is, it will be set to 1 s.
-func (s server) SetKeepAlive(t time.Duration) {
+// If the value is negative, keep alive packets are disabled. Values from 0 up to 1 s are set to 1 s, use WithKeepAlive
+// to have them rejected instead.
+func (s *Server) SetKeepAlive(t time.Duration) {
 	if 0 <= t && t < time.Second {
 		t = time.Second
 	}
 	s.keepAlive = t
 }
 
-func (s server) KeepAlive() time.Duration {
+func (s *Server) KeepAlive() time.Duration {
 	return s.keepAlive
 }
 
 // SetLogger takes a logr.Logger. If logger is nil or not of type logr.Logger, logs will be discarded and not put anywhere.
 // The default logger of this library uses the default Go log implementation and writes to std streams.
-func (s server) SetLogger(logger interface{}) {
+func (s *Server) SetLogger(logger interface{}) {
 	l, ok := logger.(logr.Logger)
 	if !ok {
 		s.log = stdr.New(log.New(io.Discard, "", 0))
@@ -156,6 +787,6 @@ func (s server) SetLogger(logger interface{}) {
 	s.log = l
 }
 
-func (s server) Logger() logr.Logger {
+func (s *Server) Logger() logr.Logger {
 	return s.log
 }
\ No newline at end of file
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"github.com/4kills/hole-punching/go/pkg/token"
+)
+
+// listenMember returns a socket standing in for a client as well as its address.
+func listenMember(t *testing.T) (*net.UDPConn, *net.UDPAddr) {
+	conn, err := net.ListenUDP(udpNetworkName, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.LocalAddr().(*net.UDPAddr)
+}
+
+// receive returns the first message of type typ received by conn, skipping other messages.
+func receive(t *testing.T, conn *net.UDPConn, typ protocol.Type) protocol.Message {
+	t.Helper()
+	buf := make([]byte, 0xffff)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("waiting for %v: %v", typ, err)
+		}
+		msg, err := protocol.Unmarshal(buf[:n])
+		if err == nil && msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func TestServer_HandleConnection_GuestCompletesStar(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.WebhookURLs = []string{"https://backend.example.com/hooks"}
+	s.WebhookSecret = "secret"
+
+	var conns []*net.UDPConn
+	roles := []protocol.Role{protocol.RoleHost, protocol.RoleGuest, protocol.RoleGuest}
+	for i, role := range roles {
+		conn, addr := listenMember(t)
+		conns = append(conns, conn)
+
+		// only the host declares the size of the domain
+		msg := protocol.Message{Type: protocol.TypeRegister, Domain: []byte("lobby"), ClientID: protocol.UUID{byte(i + 1)}, Role: role}
+		if role == protocol.RoleHost {
+			msg.Size = len(roles)
+		}
+		s.handleConnection(msg, addr, false)
+	}
+
+	if got := receive(t, conns[0], protocol.TypeReady); len(got.Peers) != 2 {
+		t.Errorf("got %v\n want both guests for host", got.Peers)
+	}
+	for _, conn := range conns[1:] {
+		if got := receive(t, conn, protocol.TypeReady); len(got.Peers) != 1 || got.Peers[0].Role != protocol.RoleHost {
+			t.Errorf("got %v\n want only the host for guest", got.Peers)
+		}
+	}
+
+	ready := 0
+	for len(s.webhooks) > 0 {
+		if (<-s.webhooks).Type == EventDomainReady {
+			ready++
+		}
+	}
+	if ready != 1 {
+		t.Errorf("got %d %v events\n want 1", ready, EventDomainReady)
+	}
+}
+
+func TestServer_HandleConnection_RepeatedRegistration(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone)
+	register := func(p protocol.Peer, metadata string) {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("a"), ClientID: p.ID, Metadata: []byte(metadata)}, p.Addr, false)
+	}
+	register(peers[0], "")
+	register(peers[1], "")
+	receive(t, conns[0], protocol.TypePeerJoined)
+
+	// waiting clients register periodically, which must not be pushed to the peers
+	register(peers[1], "")
+	receive(t, conns[1], protocol.TypePeers)
+	receiveNone(t, conns[0])
+
+	register(peers[1], "changed")
+	if got := receive(t, conns[0], protocol.TypePeerJoined); len(got.Peers) != 1 || string(got.Peers[0].Metadata) != "changed" {
+		t.Errorf("got %v\n want the changed metadata of %v", got.Peers, peers[1].ID)
+	}
+}
+
+func TestServer_HandleConnection_Secret(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the client restarts with a new endpoint, while another one tries to take over its ID
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone)
+	register := func(addr *net.UDPAddr, secret string) {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("a"), ClientID: peers[0].ID, Secret: []byte(secret)}, addr, false)
+	}
+	register(peers[0].Addr, "secret")
+
+	register(peers[2].Addr, "guessed")
+	if got := receive(t, conns[2], protocol.TypeError); got.Code != protocol.CodeIDInUse {
+		t.Errorf("got %v\n want %v", got.Code, protocol.CodeIDInUse)
+	}
+
+	register(peers[1].Addr, "secret")
+	receive(t, conns[1], protocol.TypePeers)
+	info, err := s.AddrStore.Describe("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Members) != 1 || info.Members[0].Addr != peers[1].Addr.String() {
+		t.Errorf("got %v\n want only %v", info.Members, peers[1].Addr)
+	}
+}
+
+func TestServer_HandleConnection_Authorize(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	verifier, err := token.NewHMAC([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := token.NewHMAC([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TokenVerifier = verifier
+
+	id := protocol.UUID{1}
+	sign := func(signer token.Signer, domain string, ttl time.Duration, clientID protocol.UUID) string {
+		claims := token.NewClaims(domain, ttl)
+		if !clientID.IsZero() {
+			claims.ClientID = clientID.String()
+		}
+		tok, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	tt := []struct {
+		name  string
+		token string
+	}{
+		{name: "missing token"},
+		{name: "bad signature", token: sign(other, "a", time.Minute, id)},
+		{name: "expired token", token: sign(verifier, "a", -time.Minute, id)},
+		{name: "other domain", token: sign(verifier, "b", time.Minute, id)},
+		{name: "other client", token: sign(verifier, "a", time.Minute, protocol.UUID{2})},
+	}
+	for _, tc := range tt {
+		conn, addr := listenMember(t)
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("a"), ClientID: id, Token: tc.token}, addr, false)
+		if got := receive(t, conn, protocol.TypeError); got.Code != protocol.CodeUnauthorized {
+			t.Errorf("%s: got %v\n want %v", tc.name, got.Code, protocol.CodeUnauthorized)
+		}
+	}
+	if info, _ := s.AddrStore.Describe("a"); len(info.Members) != 0 {
+		t.Errorf("got %v\n want no members after rejected registrations", info.Members)
+	}
+
+	// the claims limit the number of members of the domain
+	claims := token.NewClaims("a", time.Minute)
+	claims.MaxMembers = 2
+	limited, err := verifier.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone)
+	for _, p := range peers {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("a"), ClientID: p.ID, Token: limited}, p.Addr, false)
+	}
+	receive(t, conns[0], protocol.TypePeers)
+	receive(t, conns[1], protocol.TypePeers)
+	if got := receive(t, conns[2], protocol.TypeError); got.Code != protocol.CodeDomainFull {
+		t.Errorf("got %v\n want %v beyond the maximum members of the token", got.Code, protocol.CodeDomainFull)
+	}
+}
+
+func TestServer_HandleQuery(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	verifier, err := token.NewHMAC([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TokenVerifier = verifier
+
+	for _, m := range []Member{{ID: protocol.UUID{1}.String(), Addr: "127.0.0.1:33333"}, {ID: protocol.UUID{2}.String(), Addr: "127.0.0.1:45433"}} {
+		if _, err := s.AddrStore.ProcessAddress("a", m, ProcessOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sign := func(domain string) string {
+		tok, err := verifier.Sign(token.NewClaims(domain, time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	conn, addr := listenMember(t)
+	query := func(tok string) {
+		s.handleQuery(protocol.Message{Type: protocol.TypeQuery, Domain: []byte("a"), ClientID: protocol.UUID{3}, Token: tok}, addr)
+	}
+
+	// without token, only the state of the domain is revealed
+	query("")
+	got := receive(t, conn, protocol.TypeDomainInfo)
+	if got.Info == nil || got.Info.Members != 2 || len(got.Peers) != 0 {
+		t.Errorf("got %+v with peers %v\n want 2 members without peers", got.Info, got.Peers)
+	}
+
+	query(sign("a"))
+	if got := receive(t, conn, protocol.TypeDomainInfo); len(got.Peers) != 2 {
+		t.Errorf("got %v\n want both members for a valid token", got.Peers)
+	}
+
+	query(sign("b"))
+	if got := receive(t, conn, protocol.TypeError); got.Code != protocol.CodeUnauthorized {
+		t.Errorf("got %v\n want %v for a token of another domain", got.Code, protocol.CodeUnauthorized)
+	}
+}
+
+func TestServer_HandleConnection_Metadata(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone)
+	register := func(i int, metadata []byte) {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("m"), ClientID: peers[i].ID, Metadata: metadata, Size: 3}, peers[i].Addr, false)
+	}
+	metadataOf := func(peers []protocol.Peer, id protocol.UUID) string {
+		for _, p := range peers {
+			if p.ID == id {
+				return string(p.Metadata)
+			}
+		}
+		return ""
+	}
+
+	register(0, []byte("zero"))
+	register(1, []byte("one"))
+	if got := receive(t, conns[1], protocol.TypePeers); metadataOf(got.Peers, peers[0].ID) != "zero" {
+		t.Errorf("got %v\n want metadata %q in the peers reply", got.Peers, "zero")
+	}
+	if got := receive(t, conns[0], protocol.TypePeerJoined); metadataOf(got.Peers, peers[1].ID) != "one" {
+		t.Errorf("got %v\n want metadata %q in the push", got.Peers, "one")
+	}
+
+	register(2, make([]byte, s.MaxMetadataSize+1))
+	if got := receive(t, conns[2], protocol.TypeError); got.Code != protocol.CodeMetadataTooLarge {
+		t.Errorf("got %v\n want %v", got.Code, protocol.CodeMetadataTooLarge)
+	}
+	if info, _ := s.AddrStore.Describe("m"); len(info.Members) != 2 {
+		t.Errorf("got %d\n want %d members after oversized metadata", len(info.Members), 2)
+	}
+
+	register(2, []byte("two"))
+	got := receive(t, conns[0], protocol.TypeReady)
+	if metadataOf(got.Peers, peers[1].ID) != "one" || metadataOf(got.Peers, peers[2].ID) != "two" {
+		t.Errorf("got %v\n want metadata %q and %q in the ready announcement", got.Peers, "one", "two")
+	}
+}
+
+func TestServer_HandleLeave_Done(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		typ      protocol.Type
+		wantLeft bool
+	}{
+		{typ: protocol.TypeLeave, wantLeft: true},
+		{typ: protocol.TypeDone, wantLeft: false},
+	}
+	for _, test := range tests {
+		domain := []byte(test.typ.String())
+		remaining, _ := listenMember(t)
+		leaving, addr := listenMember(t)
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: domain, ClientID: protocol.UUID{1}}, remaining.LocalAddr().(*net.UDPAddr), false)
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: domain, ClientID: protocol.UUID{2}}, addr, false)
+		receive(t, remaining, protocol.TypePeerJoined)
+
+		packet, err := protocol.Marshal(protocol.Message{Type: test.typ, Domain: domain, ClientID: protocol.UUID{2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.handlePacket(packet, addr)
+		leaving.Close()
+
+		if info, err := s.AddrStore.Describe(string(domain)); err != nil || len(info.Members) != 1 {
+			t.Errorf("%v: got %v, %v\n want the remaining member only", test.typ, info.Members, err)
+		}
+		remaining.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		buf := make([]byte, 0xffff)
+		gotLeft := false
+		for {
+			n, err := remaining.Read(buf)
+			if err != nil {
+				break
+			}
+			if msg, err := protocol.Unmarshal(buf[:n]); err == nil && msg.Type == protocol.TypePeerLeft {
+				gotLeft = true
+			}
+		}
+		if gotLeft != test.wantLeft {
+			t.Errorf("%v: got peer left pushed %v\n want %v", test.typ, gotLeft, test.wantLeft)
+		}
+	}
+}
+
+func TestServer_ListenAndServe_RateLimited(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RateLimit, s.RateBurst = 1, 1
+	go s.ListenAndServe()
+
+	conn, err := net.DialUDP(udpNetworkName, nil, s.socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	keepAlive, err := protocol.Marshal(protocol.Message{Type: protocol.TypeKeepAlive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write(keepAlive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rejections := 0
+	buf := make([]byte, 0xffff)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if msg, err := protocol.Unmarshal(buf[:n]); err == nil && msg.Type == protocol.TypeError && msg.Code == protocol.CodeRateLimited {
+			rejections++
+		}
+	}
+	if rejections != 1 {
+		t.Errorf("got %d\n want %d rejection for %d packets exceeding the rate limit", rejections, 1, 9)
+	}
+}
+
+func TestServer_ListenAndServe_Reflexive(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.ListenAndServe()
+
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone)
+	send := func(conn *net.UDPConn, packet []byte) {
+		t.Helper()
+		if _, err := conn.WriteToUDP(packet, s.socket.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marshal := func(msg protocol.Message) []byte {
+		t.Helper()
+		packet, err := protocol.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet
+	}
+
+	// the last registration is answered to its sender and pushed to the other member
+	tests := []struct {
+		name     string
+		from, to int
+		packet   []byte
+		want     protocol.Type
+	}{
+		{name: "answer", from: 0, to: 0, packet: marshal(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: peers[0].ID, Size: 2}), want: protocol.TypePeers},
+		{name: "query", from: 1, to: 1, packet: marshal(protocol.Message{Type: protocol.TypeQuery, Domain: []byte("match")}), want: protocol.TypeDomainInfo},
+		{name: "error", from: 1, to: 1, packet: []byte{protocol.Magic, protocol.Version + 1, byte(protocol.TypeRegister)}, want: protocol.TypeError},
+		{name: "push", from: 1, to: 0, packet: marshal(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: peers[1].ID, Size: 2}), want: protocol.TypeReady},
+	}
+	for _, test := range tests {
+		send(conns[test.from], test.packet)
+
+		got := receive(t, conns[test.to], test.want)
+		if got.Reflexive == nil || got.Reflexive.String() != peers[test.to].Addr.String() {
+			t.Errorf("%s: got %v\n want %v", test.name, got.Reflexive, peers[test.to].Addr)
+		}
+	}
+}
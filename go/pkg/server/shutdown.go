@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lifecycle tracks the goroutines, listeners and connections of a server, so they can be stopped by server.Shutdown
+// and server.Close.
+type lifecycle struct {
+	mutex  sync.Mutex
+	closed bool
+	// done is closed once the server is shut down.
+	done chan struct{}
+	// running counts the background loops and the packets being handled.
+	running     sync.WaitGroup
+	httpServers []*http.Server
+	// conns are the hijacked connections of the WebSocket transport, which are not closed by http.Server.
+	conns map[io.Closer]struct{}
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{done: make(chan struct{}), conns: make(map[io.Closer]struct{})}
+}
+
+// acquire reports whether the server is still running and, if so, counts a goroutine until release is called.
+func (l *lifecycle) acquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	l.running.Add(1)
+	return true
+}
+
+func (l *lifecycle) release() {
+	l.running.Done()
+}
+
+// goroutine runs f in a new goroutine unless the server has been shut down.
+func (l *lifecycle) goroutine(f func()) bool {
+	if !l.acquire() {
+		return false
+	}
+	go func() {
+		defer l.release()
+		f()
+	}()
+	return true
+}
+
+// addHTTP registers srv to be shut down with the server. It reports false if the server has been shut down already.
+func (l *lifecycle) addHTTP(srv *http.Server) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	l.httpServers = append(l.httpServers, srv)
+	return true
+}
+
+// trackConn registers conn to be closed with the server and counts it until untrackConn is called. It reports false
+// if the server has been shut down already.
+func (l *lifecycle) trackConn(conn io.Closer) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = struct{}{}
+	l.running.Add(1)
+	return true
+}
+
+func (l *lifecycle) untrackConn(conn io.Closer) {
+	l.mutex.Lock()
+	delete(l.conns, conn)
+	l.mutex.Unlock()
+	l.running.Done()
+}
+
+// close marks the server as shut down and returns its HTTP servers and open connections. first reports whether the
+// server was running until now.
+func (l *lifecycle) close() (httpServers []*http.Server, conns []io.Closer, first bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+		first = true
+	}
+
+	conns = make([]io.Closer, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	return l.httpServers, conns, first
+}
+
+func (l *lifecycle) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+// sleep waits for d and reports false if the server is shut down in the meantime.
+func (l *lifecycle) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// serveHTTP serves srv, over HTTPS if it has a TLS config, until the server is shut down. name describes srv in logs.
+func (s *Server) serveHTTP(srv *http.Server, name string) {
+	if !s.lifecycle.addHTTP(srv) {
+		return
+	}
+
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		s.log.Error(err, name+" stopped", logKeyAddr, srv.Addr)
+	}
+}
+
+// Shutdown gracefully shuts down the server: it stops reading packets and serving the WebSocket, backend and admin
+// listeners, waits for the packets being handled and stops the keep alive, eviction and webhook loops. Afterwards,
+// the socket is closed. Webhook events which have not been delivered yet are dropped.
+//
+// If ctx expires before all of that is done, Shutdown returns the error of ctx and leaves the socket open. Call
+// server.Close to close it anyway. Once Shutdown has been called, server.ListenAndServe returns ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	httpServers, conns, first := s.lifecycle.close()
+	atomic.StoreInt32(s.serving, 0)
+	if first {
+		// unblocks the read loop without closing the socket the handlers still answer on
+		if err := s.socket.SetReadDeadline(time.Now()); err != nil {
+			s.log.V(1).Info("could not interrupt reading from udp", "error", err.Error())
+		}
+	}
+
+	var err error
+	for _, srv := range httpServers {
+		if e := srv.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.lifecycle.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if e := s.closeSocket(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// Close immediately closes the socket as well as the WebSocket, backend and admin listeners and their connections.
+// It does not wait for the packets being handled, whose answers may fail. Use server.Shutdown to stop gracefully.
+// Once Close has been called, server.ListenAndServe returns ErrServerClosed.
+func (s *Server) Close() error {
+	httpServers, conns, _ := s.lifecycle.close()
+	atomic.StoreInt32(s.serving, 0)
+
+	err := s.closeSocket()
+	for _, srv := range httpServers {
+		if e := srv.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+// closeSocket closes the socket. Closing it repeatedly is not an error.
+func (s *Server) closeSocket() error {
+	err := s.socket.Close()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
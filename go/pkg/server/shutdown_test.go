@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+// blockingStore blocks ProcessAddress until unblock is closed.
+type blockingStore struct {
+	AddressStore
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (b blockingStore) ProcessAddress(id string, m Member, opts ProcessOptions) (Registration, error) {
+	b.entered <- struct{}{}
+	<-b.unblock
+	return b.AddressStore.ProcessAddress(id, m, opts)
+}
+
+// startBlocked starts a server with a blockingStore and registers a client with it, whose registration is being
+// processed once startBlocked returns.
+func startBlocked(t *testing.T) (*Server, blockingStore, *net.UDPConn, chan error) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := blockingStore{AddressStore: s.AddrStore, entered: make(chan struct{}, 1), unblock: make(chan struct{})}
+	s.AddrStore = store
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+
+	conn, err := net.DialUDP(udpNetworkName, nil, s.socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	register, err := protocol.Marshal(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: protocol.UUID{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(register); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-store.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registration was not processed")
+	}
+	return s, store, conn, served
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s, store, conn, served := startBlocked(t)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ListenAndServe returned %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the registration was handled", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(store.unblock)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+
+	// the registration is still answered before the socket is closed
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := protocol.Unmarshal(buf[:n]); err != nil || msg.Type != protocol.TypePeers {
+		t.Errorf("got %v, %v\n want peers", msg, err)
+	}
+
+	if err := s.ListenAndServe(); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ListenAndServe after Shutdown returned %v, want %v", err, ErrServerClosed)
+	}
+	if _, err := s.socket.WriteToUDP([]byte{}, conn.LocalAddr().(*net.UDPAddr)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, want closed socket", err)
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	s, store, _, served := startBlocked(t)
+	defer close(store.unblock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := <-served; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("ListenAndServe returned %v, want %v", err, ErrServerClosed)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("closing twice returned %v", err)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AdminAddr = "127.0.0.1:0"
+
+	served := make(chan error, 1)
+	go func() { served <- s.ListenAndServe() }()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("ListenAndServe returned %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return")
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after Close returned %v", err)
+	}
+}
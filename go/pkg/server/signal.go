@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"net"
+	"time"
+)
+
+// signalKeyPrefix separates the rate limit buckets of signals from the ones of all packets.
+const signalKeyPrefix = "signal/"
+
+// handleSignal relays the signal msg from addr to its target or, if it has none, to all other members of its
+// domain the sender sees. Signals are best-effort: signals of non-members, to unknown targets or exceeding the limits
+// are dropped without answer, so they do not interfere with the registration of the sender.
+func (s *Server) handleSignal(msg protocol.Message, addr *net.UDPAddr) {
+	if len(msg.Payload) > s.MaxSignalSize {
+		s.log.V(1).Info("signal exceeded maxSignalSize: dropping it", logKeyAddr, addr.String(), "maxSignalSize", s.MaxSignalSize)
+		return
+	}
+	if !s.limiter.allow(signalKeyPrefix+addr.String(), s.SignalRate, s.SignalBurst, time.Now()) {
+		s.log.V(1).Info("remote address exceeded signal rate limit: dropping signal", logKeyAddr, addr.String())
+		return
+	}
+
+	_, domain, ok := s.admit(msg, addr, false)
+	if !ok {
+		return
+	}
+
+	info, err := s.AddrStore.Describe(domain)
+	if err != nil {
+		s.log.Error(err, "could not describe domain", logKeyAddr, addr.String())
+		return
+	}
+
+	sender, ok := findMember(info.Members, memberOf(msg, addr))
+	if !ok || sender.ID == "" {
+		s.log.V(1).Info("received signal of address which is not a member with identity: dropping it", logKeyAddr, addr.String())
+		return
+	}
+
+	relayed := protocol.Message{Type: protocol.TypeSignal, Domain: msg.Domain, ClientID: msg.ClientID, Payload: msg.Payload}
+	target := ""
+	if !msg.Target.IsZero() {
+		target = msg.Target.String()
+	}
+
+	delivered := false
+	for _, m := range info.Members {
+		if m.Addr == sender.Addr || target != "" && m.ID != target || !sender.Role.Sees(m.Role) {
+			continue
+		}
+		if _, ok := s.legacyAddrs.Load(m.Addr); ok {
+			continue // legacy clients cannot decode signals
+		}
+
+		peer, err := toPeer(m)
+		if err != nil {
+			s.log.Error(err, "could not resolve stored member, skipping it", logKeyAddr, m.Addr, logKeyID, m.ID)
+			continue
+		}
+		s.send(peer.Addr, relayed)
+		delivered = true
+	}
+
+	if !delivered && target != "" {
+		s.log.V(1).Info("signal target is not a member: dropping signal", logKeyAddr, addr.String(), "target", target)
+	}
+}
+
+// findMember returns the member of members which sent a message as m.
+func findMember(members []Member, m Member) (Member, bool) {
+	for _, v := range members {
+		if v.sentBy(m) {
+			return v, true
+		}
+	}
+	return Member{}, false
+}
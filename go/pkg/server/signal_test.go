@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+func TestServer_HandleSignal(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// sender and target are members of domain a, other of domain b and stranger of none
+	conns, peers := listenPeers(t, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone, protocol.RoleNone)
+	sender, target, other, stranger := peers[0], peers[1], peers[2], peers[3]
+	for _, p := range []struct {
+		peer   protocol.Peer
+		domain string
+	}{{sender, "a"}, {target, "a"}, {other, "b"}} {
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte(p.domain), ClientID: p.peer.ID}, p.peer.Addr, false)
+	}
+
+	signal := func(from protocol.Peer, domain string, to protocol.UUID, payload string) {
+		s.handleSignal(protocol.Message{Type: protocol.TypeSignal, Domain: []byte(domain), ClientID: from.ID, Target: to, Payload: []byte(payload)}, from.Addr)
+	}
+
+	signal(sender, "a", target.ID, "offer")
+	got := receive(t, conns[1], protocol.TypeSignal)
+	if got.ClientID != sender.ID || !bytes.Equal(got.Payload, []byte("offer")) {
+		t.Errorf("got %v from %v\n want %q from %v", got.Payload, got.ClientID, "offer", sender.ID)
+	}
+	signal(sender, "a", protocol.UUID{}, "broadcast")
+	if got := receive(t, conns[1], protocol.TypeSignal); !bytes.Equal(got.Payload, []byte("broadcast")) {
+		t.Errorf("got %q\n want %q", got.Payload, "broadcast")
+	}
+
+	signal(stranger, "a", target.ID, "from non-member")
+	signal(other, "a", target.ID, "from other domain")
+	signal(other, "b", target.ID, "to other domain")
+	receiveNone(t, conns[1])
+	receiveNone(t, conns[3])
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"net"
+	"sync"
+	"time"
+)
+
+// tenantKeyPrefix separates the rate limit buckets of tenants from the ones of addresses.
+const tenantKeyPrefix = "tenant/"
+
+// Tenant is a product sharing the server with others. Each tenant has its own namespace of domains and its own
+// quotas. Zero quotas mean no limit.
+type Tenant struct {
+	// Name identifies the tenant. It must be unique among all tenants and must not contain "/". The domains of the
+	// tenant are stored in the server.AddrStore as Name + "/" + domain id.
+	Name string
+	// MaxDomains is the maximum number of domains the tenant may have at once.
+	MaxDomains int
+	// MaxMembers is the maximum number of members of each domain of the tenant.
+	MaxMembers int
+	// PacketRate is the sustained number of packets per second accepted for the tenant from all its clients. Up to
+	// PacketBurst packets are accepted at once. Like with server.RateLimit, only the first packet exceeding the limit
+	// after an accepted one is answered.
+	PacketRate  float64
+	PacketBurst int
+}
+
+// TenantStore resolves the API keys clients attach to their messages to tenants. TenantStore must be safe for
+// concurrent use.
+type TenantStore interface {
+	// Tenant returns the tenant identified by apiKey. If there is none, ErrUnknownTenant is returned.
+	Tenant(apiKey string) (Tenant, error)
+}
+
+// Tenants is a static TenantStore mapping API keys to tenants. A tenant may be listed under several keys, e.g. while
+// rotating its key.
+type Tenants map[string]Tenant
+
+func (t Tenants) Tenant(apiKey string) (Tenant, error) {
+	tenant, ok := t[apiKey]
+	if !ok {
+		return tenant, ErrUnknownTenant
+	}
+	return tenant, nil
+}
+
+// tenantDomains counts the domains of each tenant to enforce Tenant.MaxDomains before a new domain reaches the
+// AddressStore. The counts are local to the server, even if the AddressStore is shared.
+type tenantDomains struct {
+	mutex sync.Mutex
+	// owners maps the domains in use to the name of their tenant.
+	owners map[string]string
+	counts map[string]int
+}
+
+func newTenantDomains() *tenantDomains {
+	return &tenantDomains{owners: make(map[string]string), counts: make(map[string]int)}
+}
+
+// reserve counts domain for tenant unless it is already counted. It returns ErrQuotaExceeded if this would exceed
+// the domains of the tenant and whether domain has been counted by this call.
+func (t *tenantDomains) reserve(tenant Tenant, domain string) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.owners[domain]; ok {
+		return false, nil
+	}
+	if tenant.MaxDomains > 0 && t.counts[tenant.Name] >= tenant.MaxDomains {
+		return false, fmt.Errorf("%w: tenant has %d domains", ErrQuotaExceeded, tenant.MaxDomains)
+	}
+
+	t.owners[domain] = tenant.Name
+	t.counts[tenant.Name]++
+	return true, nil
+}
+
+// release stops counting domain, e.g. because its last member left. Domains which are not counted are ignored.
+func (t *tenantDomains) release(domain string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	name, ok := t.owners[domain]
+	if !ok {
+		return
+	}
+	delete(t.owners, domain)
+	if t.counts[name]--; t.counts[name] <= 0 {
+		delete(t.counts, name)
+	}
+}
+
+// admit resolves the tenant of msg sent from addr and returns the key of its domain in the server.AddrStore. If
+// server.Tenants is nil, the domain id is the key. Messages without known API key or exceeding the packet rate of
+// their tenant are rejected.
+func (s *Server) admit(msg protocol.Message, addr *net.UDPAddr, legacy bool) (Tenant, string, bool) {
+	if s.Tenants == nil {
+		return Tenant{}, string(msg.Domain), true
+	}
+
+	tenant, domain, err := s.domainKey(msg.APIKey, msg.Domain)
+	if err != nil {
+		s.log.V(1).Info("could not resolve tenant: rejecting address", logKeyAddr, addr.String(), "error", err.Error())
+		s.reject(addr, legacy, protocol.CodeUnauthorized, fmt.Errorf("%w: %v", ErrUnauthorized, err))
+		return tenant, "", false
+	}
+	if key := tenantKeyPrefix + tenant.Name; !s.limiter.allow(key, tenant.PacketRate, tenant.PacketBurst, time.Now()) {
+		s.log.V(1).Info("tenant exceeded rate limit: dropping packet", logKeyAddr, addr.String(), logKeyTenant, tenant.Name)
+		if s.limiter.answer(key) {
+			s.reject(addr, legacy, protocol.CodeRateLimited, errRateLimited)
+		}
+		return tenant, "", false
+	}
+
+	return tenant, domain, true
+}
+
+// domainKey returns the tenant identified by apiKey and the key of domain in the server.AddrStore. If server.Tenants
+// is nil, the domain id is the key.
+func (s *Server) domainKey(apiKey string, domain []byte) (Tenant, string, error) {
+	if s.Tenants == nil {
+		return Tenant{}, string(domain), nil
+	}
+
+	tenant, err := s.Tenants.Tenant(apiKey)
+	if err != nil {
+		return tenant, "", err
+	}
+	return tenant, tenant.Name + "/" + string(domain), nil
+}
+
+// releaseDomain stops counting domain for its tenant if it has no members anymore.
+func (s *Server) releaseDomain(domain string) {
+	if s.Tenants == nil {
+		return
+	}
+
+	info, err := s.AddrStore.Describe(domain)
+	if err != nil {
+		s.log.Error(err, "could not describe domain", logKeyDomain, domain)
+		return
+	}
+	if len(info.Members) == 0 {
+		s.tenantDomains.release(domain)
+	}
+}
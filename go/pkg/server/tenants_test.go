@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+)
+
+func TestTenants_Tenant(t *testing.T) {
+	tenants := Tenants{"key": {Name: "product"}}
+
+	tenant, err := tenants.Tenant("key")
+	if err != nil || tenant.Name != "product" {
+		t.Errorf("got %v, %v\n want %v, %v", tenant.Name, err, "product", nil)
+	}
+	if _, err := tenants.Tenant("other"); !errors.Is(err, ErrUnknownTenant) {
+		t.Errorf("got %v\n want %v", err, ErrUnknownTenant)
+	}
+}
+
+func TestTenantDomains_Reserve(t *testing.T) {
+	d := newTenantDomains()
+	tenant := Tenant{Name: "product", MaxDomains: 2}
+
+	for _, domain := range []string{"product/a", "product/b"} {
+		if reserved, err := d.reserve(tenant, domain); !reserved || err != nil {
+			t.Fatalf("got %v, %v\n want %v, %v for %s", reserved, err, true, nil, domain)
+		}
+	}
+	if reserved, err := d.reserve(tenant, "product/a"); reserved || err != nil {
+		t.Errorf("got %v, %v\n want %v, %v for domain in use", reserved, err, false, nil)
+	}
+	if _, err := d.reserve(tenant, "product/c"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("got %v\n want %v", err, ErrQuotaExceeded)
+	}
+	if _, err := d.reserve(Tenant{Name: "other", MaxDomains: 1}, "other/c"); err != nil {
+		t.Errorf("got %v\n want %v for other tenant", err, nil)
+	}
+
+	d.release("product/a")
+	if reserved, err := d.reserve(tenant, "product/c"); !reserved || err != nil {
+		t.Errorf("got %v, %v\n want %v, %v after release", reserved, err, true, nil)
+	}
+}
+
+func TestServer_HandleConnection_TenantQuotas(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Tenants = Tenants{"key-of-chess": {Name: "chess", MaxDomains: 1, MaxMembers: 2}}
+
+	tests := []struct {
+		domain   string
+		apiKey   string
+		wantCode protocol.ErrorCode
+	}{
+		{domain: "match", apiKey: "key-of-chess"},
+		{domain: "match", apiKey: "key-of-chess"},
+		{domain: "match", apiKey: "key-of-chess", wantCode: protocol.CodeDomainFull},
+		{domain: "other", apiKey: "key-of-chess", wantCode: protocol.CodeQuotaExceeded},
+		{domain: "match", apiKey: "unknown", wantCode: protocol.CodeUnauthorized},
+	}
+	for i, test := range tests {
+		conn, addr := listenMember(t)
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte(test.domain), ClientID: protocol.UUID{byte(i + 1)}, APIKey: test.apiKey}, addr, false)
+
+		if test.wantCode == protocol.CodeUnknown {
+			receive(t, conn, protocol.TypePeers)
+			continue
+		}
+		if got := receive(t, conn, protocol.TypeError); got.Code != test.wantCode {
+			t.Errorf("registration %d: got %v\n want %v", i, got.Code, test.wantCode)
+		}
+	}
+}
+
+func TestServer_HandleConnection_TenantNamespaces(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Tenants = Tenants{"key-of-chess": {Name: "chess"}, "key-of-go": {Name: "go"}}
+
+	for i, apiKey := range []string{"key-of-chess", "key-of-go"} {
+		conn, addr := listenMember(t)
+		s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: protocol.UUID{byte(i + 1)}, APIKey: apiKey, Size: 2}, addr, false)
+		if got := receive(t, conn, protocol.TypePeers); len(got.Peers) != 0 {
+			t.Errorf("got %v\n want no peers of the other tenant", got.Peers)
+		}
+	}
+
+	for _, key := range []string{"chess/match", "go/match"} {
+		if info, err := s.AddrStore.Describe(key); err != nil || len(info.Members) != 1 {
+			t.Errorf("got %v, %v\n want a single member of %s", info.Members, err, key)
+		}
+	}
+	if info, err := s.AddrStore.Describe("match"); err != nil || len(info.Members) != 0 {
+		t.Errorf("got %v, %v\n want no members outside the namespaces of the tenants", info.Members, err)
+	}
+}
+
+func TestServer_Admit_TenantPacketRate(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Tenants = Tenants{"key-of-chess": {Name: "chess", PacketRate: 1, PacketBurst: 1}, "key-of-go": {Name: "go"}}
+
+	conn, addr := listenMember(t)
+	msg := protocol.Message{Type: protocol.TypeQuery, Domain: []byte("match"), APIKey: "key-of-chess"}
+	if _, key, ok := s.admit(msg, addr, false); !ok || key != "chess/match" {
+		t.Errorf("got %v, %v\n want %v, %v", key, ok, "chess/match", true)
+	}
+	if _, _, ok := s.admit(msg, addr, false); ok {
+		t.Errorf("got %v\n want %v after exceeding the packet rate of the tenant", ok, false)
+	}
+	if got := receive(t, conn, protocol.TypeError); got.Code != protocol.CodeRateLimited {
+		t.Errorf("got %v\n want %v", got.Code, protocol.CodeRateLimited)
+	}
+
+	msg.APIKey = "key-of-go"
+	if _, _, ok := s.admit(msg, addr, false); !ok {
+		t.Errorf("got %v\n want %v for other tenant", ok, true)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/4kills/hole-punching/go/pkg/server"
+
+// attribute keys of the spans of the server, matching the ones of the client
+const (
+	attrDomain  = attribute.Key("holepunch.domain")
+	attrPeer    = attribute.Key("holepunch.peer")
+	attrPeers   = attribute.Key("holepunch.peers")
+	attrIndex   = attribute.Key("holepunch.index")
+	attrTenant  = attribute.Key("holepunch.tenant")
+	attrOutcome = attribute.Key("holepunch.outcome")
+	attrCode    = attribute.Key("holepunch.error_code")
+)
+
+// tracer returns the tracer of server.TracerProvider or of the global provider if it is nil.
+func (s *Server) tracer() trace.Tracer {
+	tp := s.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// remoteContext returns a context carrying the span of the client with the W3C traceparent, if it is valid.
+func remoteContext(traceParent string) context.Context {
+	return propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": traceParent})
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookSignatureHeader is the header carrying the signature of a webhook request, see VerifyWebhook.
+const WebhookSignatureHeader = "X-Hole-Punching-Signature"
+
+const (
+	// webhookQueueSize is the number of events pending delivery. Further events are dropped.
+	webhookQueueSize = 1024
+	// webhookWorkers is the number of events delivered concurrently.
+	webhookWorkers = 4
+	webhookTimeout = 10 * time.Second
+)
+
+// ErrInvalidSignature is returned by VerifyWebhook if the signature of a webhook request is missing, does not match
+// its body or is too old.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// EventType is the kind of lifecycle event of a domain.
+type EventType string
+
+const (
+	// EventDomainCreated is sent when the first member registers with a domain.
+	EventDomainCreated EventType = "domain.created"
+	// EventMemberJoined is sent when a client registers with a domain it is not a member of yet.
+	EventMemberJoined EventType = "member.joined"
+	// EventDomainReady is sent when a domain reaches its expected size.
+	EventDomainReady EventType = "domain.ready"
+	// EventMemberLeft is sent when a member leaves its domain.
+	EventMemberLeft EventType = "member.left"
+	// EventMemberExpired is sent when a member is evicted after missing its heartbeats.
+	EventMemberExpired EventType = "member.expired"
+	// EventDomainDeleted is sent when the last member of a domain is gone or the backend deletes it.
+	EventDomainDeleted EventType = "domain.deleted"
+)
+
+// Event is the JSON body POSTed to server.WebhookURLs.
+type Event struct {
+	Type EventType `json:"type"`
+	// Domain is the key of the domain in the server.AddrStore, i.e. tenant name + "/" + domain id if the server
+	// has tenants.
+	Domain string `json:"domain"`
+	// MemberID and MemberAddr identify the member the event is about, if any.
+	MemberID   string `json:"memberId,omitempty"`
+	MemberAddr string `json:"memberAddr,omitempty"`
+	// Members is the number of members of the domain after the event.
+	Members int       `json:"members"`
+	Time    time.Time `json:"time"`
+}
+
+// emit queues e for delivery to server.WebhookURLs. It never blocks: if too many events are pending, e is dropped.
+func (s *Server) emit(e Event) {
+	if len(s.WebhookURLs) == 0 {
+		return
+	}
+	e.Time = time.Now()
+
+	select {
+	case s.webhooks <- e:
+	default:
+		s.log.Error(errors.New("webhook queue full"), "dropping event", "type", string(e.Type), logKeyDomain, e.Domain)
+	}
+}
+
+// emitMember queues an event of type t about m, which leaves remaining members in domain.
+func (s *Server) emitMember(t EventType, domain string, m Member, remaining int) {
+	s.emit(Event{Type: t, Domain: domain, MemberID: m.ID, MemberAddr: m.Addr, Members: remaining})
+}
+
+// deliverWebhooks delivers the queued events until the server is shut down or the queue is closed.
+func (s *Server) deliverWebhooks() {
+	client := &http.Client{Timeout: webhookTimeout}
+	for {
+		var e Event
+		var ok bool
+		select {
+		case e, ok = <-s.webhooks:
+			if !ok {
+				return
+			}
+		case <-s.lifecycle.done:
+			return
+		}
+
+		body, err := json.Marshal(e)
+		if err != nil {
+			s.log.Error(err, "could not encode event", "type", string(e.Type))
+			continue
+		}
+		for _, url := range s.WebhookURLs {
+			s.deliverWebhook(client, url, body)
+		}
+	}
+}
+
+// deliverWebhook POSTs body to url, retrying up to server.WebhookRetries times with exponential backoff. Retries are
+// given up once the server is shut down.
+func (s *Server) deliverWebhook(client *http.Client, url string, body []byte) {
+	backoff := s.WebhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(client, url, body, s.WebhookSecret)
+		if err == nil {
+			return
+		}
+		if attempt >= s.WebhookRetries {
+			s.log.Error(err, "could not deliver webhook, giving up", "url", url, "attempts", attempt+1)
+			return
+		}
+
+		s.log.V(1).Info("could not deliver webhook, retrying", "url", url, "error", err.Error(), "backoff", backoff)
+		if !s.lifecycle.sleep(backoff) {
+			s.log.Error(err, "could not deliver webhook before shutdown, giving up", "url", url, "attempts", attempt+1)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func postWebhook(client *http.Client, url string, body []byte, secret string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signWebhook(secret, time.Now(), body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered with status %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header of body sent at t: "t=<unix seconds>,v1=<hex HMAC-SHA256>", where the
+// HMAC is computed with secret over "<unix seconds>.<body>".
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(webhookMAC(secret, ts, body))
+}
+
+func webhookMAC(secret, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// VerifyWebhook verifies the signature header (WebhookSignatureHeader) of a webhook request with body, which must
+// have been signed with secret within maxAge. Use it in the handler of your backend receiving the events.
+func VerifyWebhook(secret, signature string, body []byte, maxAge time.Duration) error {
+	var ts, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing timestamp", ErrInvalidSignature)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("%w: signed %v ago", ErrInvalidSignature, age)
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, webhookMAC(secret, ts, body)) {
+		return fmt.Errorf("%w: signature does not match", ErrInvalidSignature)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"type":"domain.created"}`)
+	signature := signWebhook("secret", time.Now(), body)
+
+	if err := VerifyWebhook("secret", signature, body, time.Minute); err != nil {
+		t.Errorf("got %v\n want %v", err, nil)
+	}
+	if err := VerifyWebhook("other", signature, body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got %v\n want %v for other secret", err, ErrInvalidSignature)
+	}
+	if err := VerifyWebhook("secret", signature, []byte(`{}`), time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got %v\n want %v for other body", err, ErrInvalidSignature)
+	}
+	old := signWebhook("secret", time.Now().Add(-time.Hour), body)
+	if err := VerifyWebhook("secret", old, body, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got %v\n want %v for old signature", err, ErrInvalidSignature)
+	}
+}
+
+func TestServer_DeliverWebhooks(t *testing.T) {
+	received := make(chan Event, 1)
+	attempts := 0
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if err := VerifyWebhook("secret", r.Header.Get(WebhookSignatureHeader), body, time.Minute); err != nil {
+			t.Error(err)
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer hs.Close()
+
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WebhookURLs = []string{hs.URL}
+	s.WebhookSecret = "secret"
+	s.WebhookBackoff = time.Millisecond
+	s.lifecycle.goroutine(s.deliverWebhooks)
+	defer s.Shutdown(context.Background())
+
+	s.emitMember(EventMemberJoined, "match", Member{ID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Addr: "143.92.93.227:33333"}, 2)
+
+	select {
+	case e := <-received:
+		if e.Type != EventMemberJoined || e.Domain != "match" || e.MemberAddr != "143.92.93.227:33333" || e.Members != 2 {
+			t.Errorf("got %+v\n want %v event of member joining match", e, EventMemberJoined)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for webhook")
+	}
+}
+
+func TestServer_WebhookEvents_Concurrent(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the events stay queued as no worker delivers them
+	s.WebhookURLs = []string{"https://backend.example.com/hooks"}
+	s.WebhookSecret = "secret"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := protocol.Message{Type: protocol.TypeRegister, Domain: []byte("match"), ClientID: protocol.UUID{byte(i + 1)}}
+			s.handleConnection(msg, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33333 + i}, false)
+		}(i)
+	}
+	wg.Wait()
+
+	counts := make(map[EventType]int)
+	for len(s.webhooks) > 0 {
+		counts[(<-s.webhooks).Type]++
+	}
+	if counts[EventDomainCreated] != 1 || counts[EventMemberJoined] != 8 {
+		t.Errorf("got %v\n want 1 %v and 8 %v events", counts, EventDomainCreated, EventMemberJoined)
+	}
+}
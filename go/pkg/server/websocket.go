@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocketPath is the path the WebSocket transport is served at by server.ListenAndServe.
+const WebSocketPath = "/ws"
+
+// nonceLen is the length of the nonce of a UDP probe in bytes.
+const nonceLen = 16
+
+// wsSession is a client connected through the WebSocket transport. Until the client has sent its UDP probe and
+// returned the challenge sent to the endpoint of the probe, its UDP endpoint is unknown and only registrations are
+// accepted.
+type wsSession struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	udpAddr  *net.UDPAddr
+	register protocol.Message
+	nonce    string
+	// pending is the endpoint of the latest probe, which is bound once the client returns challenge.
+	pending   *net.UDPAddr
+	challenge string
+}
+
+func (w *wsSession) write(payload []byte) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	return w.conn.WriteMessage(websocket.BinaryMessage, payload)
+}
+
+// boundAddr returns the UDP endpoint of the client or nil if it has not sent its probe yet.
+func (w *wsSession) boundAddr() *net.UDPAddr {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.udpAddr
+}
+
+// WebSocketHandler returns a http.Handler serving the registration, notification and signaling protocol over
+// WebSocket for clients whose UDP traffic to the server is blocked. Each WebSocket message carries one framed
+// message. Mount it on your own HTTPS server or set server.WebSocketAddr.
+//
+// The server still needs the UDP endpoint of the client to hand it to the peers: it answers a registration with a
+// probe, which the client has to send back over UDP. The server answers the probe with a challenge sent to its
+// endpoint over UDP, which the client has to return over WebSocket, so a client cannot claim the endpoint of another
+// one by spoofing the source of its probe. Afterwards, all messages to the client are sent over WebSocket except keep
+// alive packets, which keep the NAT mapping of the UDP endpoint intact.
+func (s *Server) WebSocketHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		// clients are programs rather than browsers, hence cross origin requests need no protection
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			s.log.V(1).Info("could not upgrade to websocket", logKeyAddr, r.RemoteAddr, "error", err.Error())
+			return
+		}
+		// the connection is hijacked, hence it has to be closed on shutdown by the server itself
+		if !s.lifecycle.trackConn(conn) {
+			conn.Close()
+			return
+		}
+		defer s.lifecycle.untrackConn(conn)
+		s.serveWebSocket(&wsSession{conn: conn}, r.RemoteAddr)
+	})
+}
+
+// listenWebSocket serves the WebSocket transport at server.WebSocketAddr.
+func (s *Server) listenWebSocket() {
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, s.WebSocketHandler())
+	s.serveHTTP(&http.Server{Addr: s.WebSocketAddr, Handler: mux, TLSConfig: s.WebSocketTLS}, "websocket transport")
+}
+
+// serveWebSocket reads the messages of session until the connection is closed.
+func (s *Server) serveWebSocket(session *wsSession, remoteAddr string) {
+	defer s.closeWebSocket(session)
+	session.conn.SetReadLimit(int64(s.MaxPacketSize))
+
+	for {
+		kind, packet, err := session.conn.ReadMessage()
+		if err != nil {
+			s.log.V(1).Info("websocket closed", logKeyAddr, remoteAddr, "error", err.Error())
+			return
+		}
+		if kind != websocket.BinaryMessage {
+			continue
+		}
+		if !s.limiter.allow(remoteAddr, s.RateLimit, s.RateBurst, time.Now()) {
+			s.log.V(1).Info("remote address exceeded rate limit: dropping websocket message", logKeyAddr, remoteAddr)
+			continue
+		}
+
+		if addr := session.boundAddr(); addr != nil {
+			s.handlePacket(packet, addr)
+			continue
+		}
+		s.handleUnboundWebSocket(session, packet, remoteAddr)
+	}
+}
+
+// handleUnboundWebSocket handles packet of a session whose UDP endpoint is not known yet. Registrations are answered
+// with a probe and returned challenges bind the session, all other messages are rejected.
+func (s *Server) handleUnboundWebSocket(session *wsSession, packet []byte, remoteAddr string) {
+	msg, err := protocol.Unmarshal(packet)
+	if err == nil && msg.Type == protocol.TypeProbe {
+		s.handleChallenge(session, msg, remoteAddr)
+		return
+	}
+	if err != nil || msg.Type != protocol.TypeRegister {
+		s.log.V(1).Info("received websocket message before udp probe: rejecting it", logKeyAddr, remoteAddr)
+		s.writeWebSocket(session, protocol.Message{Type: protocol.TypeError, Code: protocol.CodeNotRegistered, Reason: "udp probe missing"})
+		return
+	}
+
+	session.mutex.Lock()
+	session.register = msg
+	if session.nonce == "" {
+		nonce := make([]byte, nonceLen)
+		if _, err := rand.Read(nonce); err != nil {
+			session.mutex.Unlock()
+			s.log.Error(err, "could not generate probe nonce")
+			return
+		}
+		session.nonce = string(nonce)
+		s.wsProbes.Store(session.nonce, session)
+	}
+	nonce := session.nonce
+	session.mutex.Unlock()
+
+	s.writeWebSocket(session, protocol.Message{Type: protocol.TypeProbe, Payload: []byte(nonce)})
+}
+
+// handleProbe answers the probe msg, which carries the nonce of a WebSocket session, with a challenge sent to the
+// UDP endpoint addr the probe was sent from. The session is bound to addr once the challenge is returned over
+// WebSocket, as the source of the probe may be spoofed.
+func (s *Server) handleProbe(msg protocol.Message, addr *net.UDPAddr) {
+	v, ok := s.wsProbes.Load(string(msg.Payload))
+	if !ok {
+		s.log.V(1).Info("received probe with unknown nonce: rejecting address", logKeyAddr, addr.String(), "nonce", hex.EncodeToString(msg.Payload))
+		return
+	}
+	session := v.(*wsSession)
+
+	session.mutex.Lock()
+	if session.udpAddr != nil {
+		session.mutex.Unlock()
+		return // the probe has been sent repeatedly
+	}
+	// a challenge is only valid for the endpoint it was sent to
+	if session.pending == nil || session.pending.String() != addr.String() {
+		challenge := make([]byte, nonceLen)
+		if _, err := rand.Read(challenge); err != nil {
+			session.mutex.Unlock()
+			s.log.Error(err, "could not generate probe challenge")
+			return
+		}
+		session.pending = addr
+		session.challenge = string(challenge)
+	}
+	challenge := session.challenge
+	session.mutex.Unlock()
+
+	// the challenge must reach the UDP endpoint even if another session is bound to it
+	payload, err := protocol.Marshal(protocol.Message{Type: protocol.TypeProbe, Payload: []byte(challenge), Reflexive: addr})
+	if err != nil {
+		s.log.Error(err, "could not encode message", logKeyAddr, addr.String(), "type", protocol.TypeProbe.String())
+		return
+	}
+	if _, err := s.socket.WriteToUDP(payload, addr); err != nil {
+		s.log.Error(err, "writing to remote address ; socket listening on port", logKeyAddr, addr.String(), "port", s.socket.LocalAddr().String())
+	}
+}
+
+// handleChallenge binds session to the UDP endpoint its challenge was sent to if msg returns the challenge and
+// processes the registration of the session.
+func (s *Server) handleChallenge(session *wsSession, msg protocol.Message, remoteAddr string) {
+	session.mutex.Lock()
+	if session.challenge == "" || subtle.ConstantTimeCompare(msg.Payload, []byte(session.challenge)) != 1 {
+		session.mutex.Unlock()
+		s.log.V(1).Info("received wrong probe challenge over websocket: dropping it", logKeyAddr, remoteAddr)
+		return
+	}
+	addr := session.pending
+	session.udpAddr = addr
+	register := session.register
+	session.mutex.Unlock()
+
+	s.wsProbes.Delete(session.nonce)
+	s.wsConns.Store(addr.String(), session)
+	s.log.V(1).Info("bound websocket to udp endpoint", logKeyAddr, addr.String())
+
+	s.handleConnection(register, addr, false)
+}
+
+// closeWebSocket forgets session. Its member stays registered until it leaves or misses its heartbeats.
+func (s *Server) closeWebSocket(session *wsSession) {
+	session.mutex.Lock()
+	if session.nonce != "" {
+		s.wsProbes.Delete(session.nonce)
+	}
+	if session.udpAddr != nil {
+		if v, ok := s.wsConns.Load(session.udpAddr.String()); ok && v == session {
+			s.wsConns.Delete(session.udpAddr.String())
+		}
+	}
+	session.mutex.Unlock()
+
+	session.conn.Close()
+}
+
+func (s *Server) writeWebSocket(session *wsSession, msg protocol.Message) {
+	payload, err := protocol.Marshal(msg)
+	if err != nil {
+		s.log.Error(err, "could not encode message", "type", msg.Type.String())
+		return
+	}
+	if err := session.write(payload); err != nil {
+		s.log.V(1).Info("could not write to websocket", "error", err.Error())
+	}
+}
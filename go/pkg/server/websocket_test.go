@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/4kills/hole-punching/go/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket starts s and connects to its WebSocket transport.
+func dialWebSocket(t *testing.T, s *Server) *websocket.Conn {
+	go s.ListenAndServe()
+	ts := httptest.NewServer(s.WebSocketHandler())
+	t.Cleanup(ts.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+WebSocketPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// writeWebSocket sends msg over conn.
+func writeWebSocket(t *testing.T, conn *websocket.Conn, msg protocol.Message) {
+	t.Helper()
+	payload, err := protocol.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveWebSocket returns the first message of type typ received over conn, skipping other messages.
+func receiveWebSocket(t *testing.T, conn *websocket.Conn, typ protocol.Type) protocol.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %v: %v", typ, err)
+		}
+		msg, err := protocol.Unmarshal(payload)
+		if err == nil && msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+// probe sends a probe with nonce from conn to s over UDP.
+func probe(t *testing.T, s *Server, conn *net.UDPConn, nonce []byte) {
+	t.Helper()
+	packet, err := protocol.Marshal(protocol.Message{Type: protocol.TypeProbe, Payload: nonce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteToUDP(packet, s.socket.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_WebSocket_Register(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ws := dialWebSocket(t, s)
+	udp, addr := listenMember(t)
+
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeRegister, Domain: []byte("relayed"), ClientID: protocol.UUID{1}, Size: 2})
+	nonce := receiveWebSocket(t, ws, protocol.TypeProbe).Payload
+	if len(nonce) != nonceLen {
+		t.Fatalf("got nonce of %d bytes\n want %d", len(nonce), nonceLen)
+	}
+	probe(t, s, udp, nonce)
+	challenge := receive(t, udp, protocol.TypeProbe).Payload
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeProbe, Payload: challenge})
+
+	// the answer to the registration is sent over WebSocket and carries the UDP endpoint
+	got := receiveWebSocket(t, ws, protocol.TypePeers)
+	if got.Reflexive == nil || got.Reflexive.String() != addr.String() {
+		t.Errorf("got reflexive endpoint %v\n want %v", got.Reflexive, addr)
+	}
+
+	// pushes to the member are sent over WebSocket as well
+	other, otherAddr := listenMember(t)
+	s.handleConnection(protocol.Message{Type: protocol.TypeRegister, Domain: []byte("relayed"), ClientID: protocol.UUID{2}, Size: 2}, otherAddr, false)
+	if got := receiveWebSocket(t, ws, protocol.TypeReady); len(got.Peers) != 1 || got.Peers[0].Addr.String() != otherAddr.String() {
+		t.Errorf("got %v\n want the other member", got.Peers)
+	}
+	if got := receive(t, other, protocol.TypeReady); len(got.Peers) != 1 || got.Peers[0].Addr.String() != addr.String() {
+		t.Errorf("got %v\n want the UDP endpoint of the WebSocket member", got.Peers)
+	}
+}
+
+func TestServer_WebSocket_WrongNonce(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ws := dialWebSocket(t, s)
+	udp, addr := listenMember(t)
+
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeRegister, Domain: []byte("relayed"), ClientID: protocol.UUID{1}})
+	nonce := receiveWebSocket(t, ws, protocol.TypeProbe).Payload
+	wrong := append([]byte(nil), nonce...)
+	wrong[0]++
+	probe(t, s, udp, wrong)
+	time.Sleep(100 * time.Millisecond) // lets the server handle the probe
+
+	// the WebSocket is not bound, hence all messages but registrations are still rejected
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeHeartbeat, Domain: []byte("relayed"), ClientID: protocol.UUID{1}})
+	if got := receiveWebSocket(t, ws, protocol.TypeError); got.Code != protocol.CodeNotRegistered {
+		t.Errorf("got %v\n want %v", got.Code, protocol.CodeNotRegistered)
+	}
+	if info, err := s.AddrStore.Describe("relayed"); err != nil || len(info.Members) != 0 {
+		t.Errorf("got %v, %v\n want no members", info.Members, err)
+	}
+	if _, ok := s.wsConns.Load(addr.String()); ok {
+		t.Errorf("got websocket bound to %v\n want none", addr)
+	}
+}
+
+func TestServer_WebSocket_SpoofedProbe(t *testing.T) {
+	s, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ws := dialWebSocket(t, s)
+	udp, addr := listenMember(t)
+	victim, victimAddr := listenMember(t)
+
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeRegister, Domain: []byte("relayed"), ClientID: protocol.UUID{1}})
+	nonce := receiveWebSocket(t, ws, protocol.TypeProbe).Payload
+	probe(t, s, udp, nonce)
+	challenge := receive(t, udp, protocol.TypeProbe).Payload
+
+	// a probe with the source of the victim invalidates the challenge of the own endpoint, and the challenge for the
+	// victim only reaches the victim
+	s.handleProbe(protocol.Message{Type: protocol.TypeProbe, Payload: nonce}, victimAddr)
+	if got := receive(t, victim, protocol.TypeProbe).Payload; string(got) == string(challenge) {
+		t.Errorf("got the challenge of %v\n want a new one for %v", addr, victimAddr)
+	}
+	writeWebSocket(t, ws, protocol.Message{Type: protocol.TypeProbe, Payload: challenge})
+	time.Sleep(100 * time.Millisecond) // lets the server handle the challenge
+
+	for _, a := range []*net.UDPAddr{addr, victimAddr} {
+		if _, ok := s.wsConns.Load(a.String()); ok {
+			t.Errorf("got websocket bound to %v\n want none", a)
+		}
+	}
+	if info, err := s.AddrStore.Describe("relayed"); err != nil || len(info.Members) != 0 {
+		t.Errorf("got %v, %v\n want no members", info.Members, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Package token implements signed join tokens which authorize a client to register with a domain of the rendezvous
+// server.
+//
+// Tokens are compact JSON Web Tokens (JWT) signed with either HMAC-SHA256 (HS256) using a shared secret or Ed25519
+// (EdDSA) using a key pair. They are minted by a trusted backend, handed to the client and verified by the server.
+package token
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalid is returned if a token is malformed, signed with another algorithm or key, or its signature does
+	// not match.
+	ErrInvalid = errors.New("invalid token")
+	// ErrExpired is returned if a token is past its expiry.
+	ErrExpired = errors.New("token expired")
+	// ErrInvalidKey is returned by the constructors of signers and verifiers if the key or secret cannot be used.
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+const (
+	algHS256 = "HS256"
+	algEdDSA = "EdDSA"
+)
+
+// Claims are the statements of a join token.
+type Claims struct {
+	// Subject identifies the user the token was issued to. It is informational only.
+	Subject string `json:"sub,omitempty"`
+	// Domain is the domain id the token grants access to.
+	Domain string `json:"dom"`
+	// ClientID optionally binds the token to the client with this UUID (in canonical textual representation).
+	ClientID string `json:"cid,omitempty"`
+	// MaxMembers optionally limits the number of members the domain may have when registering with this token.
+	// Zero means no limit.
+	MaxMembers int `json:"max,omitempty"`
+	// ExpiresAt is the time (in seconds since the Unix epoch) after which the token is no longer accepted. It is
+	// mandatory.
+	ExpiresAt int64 `json:"exp"`
+}
+
+// NewClaims returns claims for domain which expire after ttl.
+func NewClaims(domain string, ttl time.Duration) Claims {
+	return Claims{Domain: domain, ExpiresAt: time.Now().Add(ttl).Unix()}
+}
+
+// Valid returns ErrExpired if the claims have expired at now.
+func (c Claims) Valid(now time.Time) error {
+	if now.Unix() >= c.ExpiresAt {
+		return fmt.Errorf("%w: expired at %s", ErrExpired, time.Unix(c.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Signer mints tokens.
+type Signer interface {
+	Sign(c Claims) (string, error)
+}
+
+// Verifier verifies tokens. Verify returns the claims of token if the signature matches and the claims are valid.
+// Verifier must be safe for concurrent use.
+type Verifier interface {
+	Verify(token string) (Claims, error)
+}
+
+// HMAC signs and verifies HS256 tokens with a shared secret.
+type HMAC struct {
+	secret []byte
+}
+
+// NewHMAC returns a Signer and Verifier using secret. The secret should be at least 32 random bytes. An empty secret
+// is rejected with ErrInvalidKey, as anyone could mint valid tokens with it.
+func NewHMAC(secret []byte) (HMAC, error) {
+	if len(secret) == 0 {
+		return HMAC{}, fmt.Errorf("%w: empty secret", ErrInvalidKey)
+	}
+	return HMAC{secret: append([]byte(nil), secret...)}, nil
+}
+
+// Sign returns ErrInvalidKey for the zero HMAC, whose secret is empty.
+func (h HMAC) Sign(c Claims) (string, error) {
+	if len(h.secret) == 0 {
+		return "", fmt.Errorf("%w: empty secret", ErrInvalidKey)
+	}
+	return sign(algHS256, c, h.mac)
+}
+
+// Verify returns ErrInvalidKey for the zero HMAC, whose secret is empty, so it does not accept tokens anyone could
+// mint.
+func (h HMAC) Verify(token string) (Claims, error) {
+	if len(h.secret) == 0 {
+		return Claims{}, fmt.Errorf("%w: empty secret", ErrInvalidKey)
+	}
+	return verify(algHS256, token, func(signed, sig []byte) bool {
+		return hmac.Equal(sig, h.mac(signed))
+	})
+}
+
+func (h HMAC) mac(signed []byte) []byte {
+	m := hmac.New(sha256.New, h.secret)
+	m.Write(signed)
+	return m.Sum(nil)
+}
+
+// Ed25519Signer signs EdDSA tokens with a private key.
+type Ed25519Signer struct {
+	key ed25519.PrivateKey
+}
+
+// NewEd25519Signer returns a Signer using key. Keys which are not ed25519.PrivateKeySize bytes long are rejected with
+// ErrInvalidKey.
+func NewEd25519Signer(key ed25519.PrivateKey) (Ed25519Signer, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return Ed25519Signer{}, fmt.Errorf("%w: private key of %d bytes, want %d", ErrInvalidKey, len(key), ed25519.PrivateKeySize)
+	}
+	return Ed25519Signer{key: key}, nil
+}
+
+// Sign returns ErrInvalidKey for the zero Ed25519Signer instead of panicking.
+func (e Ed25519Signer) Sign(c Claims) (string, error) {
+	if len(e.key) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("%w: private key of %d bytes, want %d", ErrInvalidKey, len(e.key), ed25519.PrivateKeySize)
+	}
+	return sign(algEdDSA, c, func(signed []byte) []byte {
+		return ed25519.Sign(e.key, signed)
+	})
+}
+
+// Ed25519Verifier verifies EdDSA tokens with a public key. The server only needs the public key, so the private key
+// can remain with the backend minting the tokens.
+type Ed25519Verifier struct {
+	key ed25519.PublicKey
+}
+
+// NewEd25519Verifier returns a Verifier using key. Keys which are not ed25519.PublicKeySize bytes long are rejected
+// with ErrInvalidKey.
+func NewEd25519Verifier(key ed25519.PublicKey) (Ed25519Verifier, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return Ed25519Verifier{}, fmt.Errorf("%w: public key of %d bytes, want %d", ErrInvalidKey, len(key), ed25519.PublicKeySize)
+	}
+	return Ed25519Verifier{key: key}, nil
+}
+
+// Verify returns ErrInvalidKey for the zero Ed25519Verifier instead of panicking.
+func (e Ed25519Verifier) Verify(token string) (Claims, error) {
+	if len(e.key) != ed25519.PublicKeySize {
+		return Claims{}, fmt.Errorf("%w: public key of %d bytes, want %d", ErrInvalidKey, len(e.key), ed25519.PublicKeySize)
+	}
+	return verify(algEdDSA, token, func(signed, sig []byte) bool {
+		return ed25519.Verify(e.key, signed, sig)
+	})
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+var encoding = base64.RawURLEncoding
+
+func sign(alg string, c Claims, sig func(signed []byte) []byte) (string, error) {
+	h, err := json.Marshal(header{Alg: alg, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	signed := encoding.EncodeToString(h) + "." + encoding.EncodeToString(p)
+	return signed + "." + encoding.EncodeToString(sig([]byte(signed))), nil
+}
+
+func verify(alg string, token string, valid func(signed, sig []byte) bool) (Claims, error) {
+	var c Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("%w: want 3 parts, got %d", ErrInvalid, len(parts))
+	}
+
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return c, err
+	}
+	if h.Alg != alg {
+		return c, fmt.Errorf("%w: algorithm %q, want %q", ErrInvalid, h.Alg, alg)
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return c, fmt.Errorf("%w: signature: %v", ErrInvalid, err)
+	}
+	if !valid([]byte(parts[0]+"."+parts[1]), sig) {
+		return c, fmt.Errorf("%w: signature mismatch", ErrInvalid)
+	}
+
+	if err := decode(parts[1], &c); err != nil {
+		return c, err
+	}
+
+	return c, c.Valid(time.Now())
+}
+
+func decode(part string, v interface{}) error {
+	b, err := encoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	return nil
+}
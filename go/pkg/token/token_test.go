@@ -0,0 +1,148 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacOf := func(secret []byte) HMAC {
+		h, err := NewHMAC(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	signer, err := NewEd25519Signer(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := NewEd25519Verifier(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherVerifier, err := NewEd25519Verifier(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := NewClaims("myDomain", time.Minute)
+	valid.Subject = "user-1"
+	valid.MaxMembers = 4
+	expired := NewClaims("myDomain", -time.Minute)
+
+	tt := []struct {
+		signer   Signer
+		verifier Verifier
+		claims   Claims
+		wantErr  error
+	}{
+		{signer: hmacOf([]byte("secret")), verifier: hmacOf([]byte("secret")), claims: valid},
+		{signer: hmacOf([]byte("secret")), verifier: hmacOf([]byte("other")), claims: valid, wantErr: ErrInvalid},
+		{signer: hmacOf([]byte("secret")), verifier: hmacOf([]byte("secret")), claims: expired, wantErr: ErrExpired},
+		{signer: signer, verifier: verifier, claims: valid},
+		{signer: signer, verifier: otherVerifier, claims: valid, wantErr: ErrInvalid},
+		{signer: signer, verifier: hmacOf(pub), claims: valid, wantErr: ErrInvalid},
+	}
+
+	for _, tc := range tt {
+		tok, err := tc.signer.Sign(tc.claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := tc.verifier.Verify(tok)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("got %v\n want %v", err, tc.wantErr)
+			continue
+		}
+		if err == nil && got != tc.claims {
+			t.Errorf("got %+v\n want %+v", got, tc.claims)
+		}
+	}
+}
+
+func TestVerify_Tampered(t *testing.T) {
+	h, err := NewHMAC([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := h.Sign(NewClaims("myDomain", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := h.Sign(NewClaims("otherDomain", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payload of other with signature of tok
+	parts, otherParts := strings.Split(tok, "."), strings.Split(other, ".")
+	tampered := parts[0] + "." + otherParts[1] + "." + parts[2]
+
+	if _, err := h.Verify(tampered); !errors.Is(err, ErrInvalid) {
+		t.Errorf("got %v\n want %v", err, ErrInvalid)
+	}
+	if _, err := h.Verify("not a token"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("got %v\n want %v", err, ErrInvalid)
+	}
+}
+
+func TestNew_InvalidKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewHMAC(nil); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for empty secret", err, ErrInvalidKey)
+	}
+	if _, err := NewEd25519Signer(priv[:ed25519.PrivateKeySize-1]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for short private key", err, ErrInvalidKey)
+	}
+	// a private key is no public key and would make ed25519.Verify panic
+	if _, err := NewEd25519Verifier(ed25519.PublicKey(priv)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for private key as public key", err, ErrInvalidKey)
+	}
+	if _, err := NewEd25519Verifier(pub[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for short public key", err, ErrInvalidKey)
+	}
+}
+
+func TestZeroValue_InvalidKey(t *testing.T) {
+	h, err := NewHMAC([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := h.Sign(NewClaims("myDomain", time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (HMAC{}).Sign(NewClaims("myDomain", time.Minute)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for signing with zero HMAC", err, ErrInvalidKey)
+	}
+	if _, err := (HMAC{}).Verify(tok); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for verifying with zero HMAC", err, ErrInvalidKey)
+	}
+	if _, err := (Ed25519Signer{}).Sign(NewClaims("myDomain", time.Minute)); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for signing with zero Ed25519Signer", err, ErrInvalidKey)
+	}
+	if _, err := (Ed25519Verifier{}).Verify(tok); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("got %v\n want %v for verifying with zero Ed25519Verifier", err, ErrInvalidKey)
+	}
+}